@@ -15,9 +15,13 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package agent
 
 import (
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"trellis.tech/kolekti/prome_exporters/conf"
+	"trellis.tech/kolekti/prome_exporters/internal"
 	"trellis.tech/kolekti/prome_exporters/plugins"
 	"trellis.tech/kolekti/prome_exporters/plugins/inputs"
 	"trellis.tech/kolekti/prome_exporters/plugins/outputs"
@@ -32,12 +36,22 @@ import (
 
 const minInterval = time.Second * 1
 
+// outputCloseTimeout is the max time waiting for the output closed when the agent is stopped
+const outputCloseTimeout = 10 * time.Second
+
 // Agent runs a set of plugins.
 type Agent struct {
 	Config *conf.Config
 
 	Logger log.Logger
 
+	// Host is the host identity resolved from the config
+	Host string
+
+	// configHash is the sha256 of the config file, startTime is the time of Run
+	configHash string
+	startTime  time.Time
+
 	stopChan chan struct{}
 
 	runningInputs []*runningInput
@@ -49,6 +63,10 @@ type Agent struct {
 }
 
 type runningInput struct {
+	// gatherFailures is the number of the gathers failed, the first field is aligned for atomic
+	gatherFailures uint64
+
+	name     string
 	input    *inputs.Input
 	logger   log.Logger
 	interval time.Duration
@@ -60,11 +78,27 @@ type runningInput struct {
 	metricsCollector plugins.InputMetricsCollector
 
 	stopChan chan struct{}
+
+	// mu guards the state of the last gather
+	mu             sync.Mutex
+	lastGatherTime time.Time
+	lastError      string
+	series         int
 }
 
 type runningOutput struct {
+	name     string
 	output   plugins.Output
 	stopChan chan struct{}
+	// done is closed when the output is closed, it is nil if the output is not running
+	done chan struct{}
+
+	// mu guards the state of the writes
+	mu            sync.Mutex
+	lastWriteTime time.Time
+	lastError     string
+	writes        uint64
+	writeErrors   uint64
 }
 
 // NewAgent returns an Agent for the given Config.
@@ -80,6 +114,7 @@ func NewAgent(cfg *conf.Config, logger log.Logger) (*Agent, error) {
 	if err := a.checkConfig(); err != nil {
 		return nil, err
 	}
+	a.configHash = cfg.Hash()
 	return a, nil
 }
 
@@ -91,6 +126,23 @@ func (p *Agent) checkConfig() error {
 	if p.Config.Exporter.MetricBatchSize == 0 {
 		p.Config.Exporter.MetricBatchSize = 10000
 	}
+
+	hostConfig := p.Config.Exporter.Host
+	host, err := internal.ResolveHost(hostConfig.Source, hostConfig.Interface, hostConfig.Value, hostConfig.IPv6)
+	if err != nil {
+		// only a source configured is required, the default falls back to the hostname,
+		// eg: the hosts without an ipv4 address except the loopback
+		if hostConfig.Source != "" {
+			return errcode.Newf("failed to resolve host identity: %v", err)
+		}
+		level.Warn(p.Logger).Log("msg", "resolve_default_host_failed", "source", internal.DefaultHostSource, "error", err)
+		if host, err = os.Hostname(); err != nil {
+			return errcode.Newf("failed to resolve host identity: %v", err)
+		}
+	}
+	p.Host = host
+	level.Info(p.Logger).Log("msg", "resolve_host", "source", hostConfig.Source, "host", host)
+
 	// inputs
 	for _, inputConfig := range p.Config.Inputs {
 
@@ -106,6 +158,7 @@ func (p *Agent) checkConfig() error {
 		logger := log.WithPrefix(p.Logger, "input", inputConfig.Name)
 		opts := []plugins.Option{
 			plugins.Logger(logger),
+			plugins.Host(p.Host),
 		}
 
 		if inputConfig.Options != nil {
@@ -115,6 +168,7 @@ func (p *Agent) checkConfig() error {
 		level.Info(logger).Log("msg", "init_input", "interval", interval)
 
 		runningInput := &runningInput{
+			name:     inputConfig.Name,
 			input:    input,
 			interval: interval,
 			logger:   logger,
@@ -152,6 +206,7 @@ func (p *Agent) checkConfig() error {
 
 		opts := []plugins.Option{
 			plugins.Logger(log.WithPrefix(p.Logger, "output", p.Config.Output.Name)),
+			plugins.Host(p.Host),
 		}
 
 		if p.Config.Output.Options != nil {
@@ -162,7 +217,7 @@ func (p *Agent) checkConfig() error {
 		if err != nil {
 			return err
 		}
-		p.runningOutput = &runningOutput{output: output, stopChan: make(chan struct{})}
+		p.runningOutput = &runningOutput{name: p.Config.Output.Name, output: output, stopChan: make(chan struct{})}
 	}
 	return nil
 }
@@ -174,7 +229,9 @@ func (p *Agent) runInputs() error {
 		switch input.input.InputType() {
 		case plugins.InputTypePrometheusCollector:
 			metricFamilies, err := input.promeGatherer.Gather()
+			input.record(metricFamilies, err)
 			if err != nil {
+				atomic.AddUint64(&input.gatherFailures, 1)
 				level.Error(input.logger).Log("error", err.Error())
 				return nil, err
 			}
@@ -190,9 +247,14 @@ func (p *Agent) runInputs() error {
 			return metricFamilies, nil
 		case plugins.InputTypeMetricsCollector:
 			metrics, err := input.metricsCollector.Gather()
+			input.record(metrics, err)
 			if err != nil {
-				level.Error(input.logger).Log("error", err.Error())
-				return nil, err
+				failures := atomic.AddUint64(&input.gatherFailures, 1)
+				level.Error(input.logger).Log("msg", "gather_failed", "failures", failures, "error", err.Error())
+				// the metrics gathered with the error are kept, eg: the up metrics of the urls failed
+				if len(metrics) == 0 {
+					return nil, err
+				}
 			}
 
 			return metrics, nil
@@ -200,6 +262,12 @@ func (p *Agent) runInputs() error {
 		return nil, nil
 	}
 	for _, input := range p.runningInputs {
+		if service, ok := input.metricsCollector.(plugins.ServiceInput); ok {
+			if err := service.Start(); err != nil {
+				level.Error(input.logger).Log("msg", "start_service_input_failed", "error", err)
+				return err
+			}
+		}
 		if _, err := gather(input); err != nil {
 			return err
 		}
@@ -243,6 +311,7 @@ func (p *Agent) runOutputs() error {
 		return err
 	}
 
+	output.done = make(chan struct{})
 	go func(runOut *runningOutput) {
 		for {
 			select {
@@ -288,6 +357,15 @@ func (p *Agent) runOutputs() error {
 							}
 						}
 
+						if hostLabel := p.Config.Exporter.Host.Label; hostLabel != "" {
+							host := p.Host
+							for _, metric := range metricFamily.Metric {
+								if !hasLabel(metric, hostLabel) {
+									metric.Label = append(metric.Label, &dto.LabelPair{Name: &hostLabel, Value: &host})
+								}
+							}
+						}
+
 						mapMetrics[mf.GetName()] = mf
 					}
 					if len(names) == 0 {
@@ -301,7 +379,9 @@ func (p *Agent) runOutputs() error {
 						metrics = append(metrics, mf)
 					}
 
-					if err := runOut.output.Write(metrics); err != nil {
+					err := runOut.output.Write(metrics)
+					runOut.record(err)
+					if err != nil {
 						level.Error(p.Logger).Log("msg", "write_output_failed", "buffer_length", lenBuffer, "error", err)
 						break
 					}
@@ -312,6 +392,7 @@ func (p *Agent) runOutputs() error {
 				if err := runOut.output.Close(); err != nil {
 					level.Error(p.Logger).Log("msg", "failed_stop_output", "error", err)
 				}
+				close(runOut.done)
 				return
 			}
 		}
@@ -320,6 +401,15 @@ func (p *Agent) runOutputs() error {
 	return nil
 }
 
+func hasLabel(metric *dto.Metric, name string) bool {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Agent) runMetricsChan() {
 	go func() {
 		for {
@@ -350,16 +440,33 @@ func (p *Agent) stopRunningInputs() {
 		if input.input.InputType() == plugins.InputTypePrometheusCollector {
 			input.promeRegisterer.Unregister(input.promeCollector)
 		}
+		if service, ok := input.metricsCollector.(plugins.ServiceInput); ok {
+			service.Stop()
+		}
 	}
 }
 
+// stopRunningOutputs stops the output and waits for it closed, so the requests sent by Close,
+// such as the deletes of the pushgateway, are done before the process exits
 func (p *Agent) stopRunningOutputs() {
-	if p.runningOutput != nil && p.runningOutput.stopChan != nil {
-		p.runningOutput.stopChan <- struct{}{}
+	runOut := p.runningOutput
+	if runOut == nil || runOut.done == nil {
+		return
+	}
+	close(runOut.stopChan)
+
+	timer := time.NewTimer(outputCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-runOut.done:
+	case <-timer.C:
+		level.Warn(p.Logger).Log("msg", "close_output_timeout", "output", runOut.name, "timeout", outputCloseTimeout)
 	}
+	runOut.done = nil
 }
 
 func (p *Agent) Run() error {
+	p.startTime = time.Now()
 	p.runMetricsChan()
 	if err := p.runInputs(); err != nil {
 		return err
@@ -0,0 +1,146 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Status is the runtime state of the agent
+type Status struct {
+	ConfigHash    string    `json:"config_hash"`
+	Host          string    `json:"host"`
+	StartTime     time.Time `json:"start_time"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+}
+
+// InputStatus is the runtime state of an input
+type InputStatus struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Service is true if the input receives the metrics in the background
+	Service  bool   `json:"service"`
+	Interval string `json:"interval"`
+
+	LastGatherTime time.Time `json:"last_gather_time"`
+	LastError      string    `json:"last_error"`
+	GatherFailures uint64    `json:"gather_failures"`
+	// Series is the number of the series of the last gather
+	Series int `json:"series"`
+}
+
+// OutputStatus is the runtime state of the output
+type OutputStatus struct {
+	Name string `json:"name"`
+
+	LastWriteTime time.Time `json:"last_write_time"`
+	LastError     string    `json:"last_error"`
+	Writes        uint64    `json:"writes"`
+	WriteErrors   uint64    `json:"write_errors"`
+
+	// BufferLength is the number of the metric families waiting for writing, at most BufferLimit
+	BufferLength int64 `json:"buffer_length"`
+	BufferLimit  int64 `json:"buffer_limit"`
+}
+
+// Status returns the runtime state of the agent
+func (p *Agent) Status() *Status {
+	s := &Status{
+		ConfigHash: p.configHash,
+		Host:       p.Host,
+		StartTime:  p.startTime,
+	}
+	if !p.startTime.IsZero() {
+		s.UptimeSeconds = time.Since(p.startTime).Seconds()
+	}
+	return s
+}
+
+// InputStatuses returns the runtime states of the inputs in the order of the config
+func (p *Agent) InputStatuses() []*InputStatus {
+	statuses := make([]*InputStatus, 0, len(p.runningInputs))
+	for _, input := range p.runningInputs {
+		_, service := input.metricsCollector.(plugins.ServiceInput)
+
+		input.mu.Lock()
+		statuses = append(statuses, &InputStatus{
+			Name:           input.name,
+			Type:           input.input.InputType().String(),
+			Service:        service,
+			Interval:       input.interval.String(),
+			LastGatherTime: input.lastGatherTime,
+			LastError:      input.lastError,
+			GatherFailures: atomic.LoadUint64(&input.gatherFailures),
+			Series:         input.series,
+		})
+		input.mu.Unlock()
+	}
+	return statuses
+}
+
+// OutputStatuses returns the runtime states of the outputs, the agent has one output now
+func (p *Agent) OutputStatuses() []*OutputStatus {
+	output := p.runningOutput
+	if output == nil {
+		return nil
+	}
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	return []*OutputStatus{{
+		Name:          output.name,
+		LastWriteTime: output.lastWriteTime,
+		LastError:     output.lastError,
+		Writes:        output.writes,
+		WriteErrors:   output.writeErrors,
+		BufferLength:  p.metricsBuffer.Length(),
+		BufferLimit:   p.Config.Exporter.MetricBufferLimit,
+	}}
+}
+
+// record keeps the state of a gather
+func (p *runningInput) record(metrics []*dto.MetricFamily, err error) {
+	series := 0
+	for _, mf := range metrics {
+		series += len(mf.GetMetric())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastGatherTime = time.Now()
+	p.series = series
+	p.lastError = ""
+	if err != nil {
+		p.lastError = err.Error()
+	}
+}
+
+// record keeps the state of a write
+func (p *runningOutput) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastWriteTime = time.Now()
+	p.writes++
+	p.lastError = ""
+	if err != nil {
+		p.writeErrors++
+		p.lastError = err.Error()
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/version"
+	"trellis.tech/kolekti/prome_exporters/agent"
+)
+
+// statusResult is the build information with the runtime state of the agent
+type statusResult struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+
+	*agent.Status
+}
+
+// registerAPI registers the introspection api of the agent
+func registerAPI(mux *http.ServeMux, a *agent.Agent) {
+	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, &statusResult{
+			Version:   version.Version,
+			Revision:  version.Revision,
+			Branch:    version.Branch,
+			BuildDate: version.BuildDate,
+			GoVersion: version.GoVersion,
+			Status:    a.Status(),
+		}, a.Logger)
+	})
+	mux.HandleFunc("/api/v1/inputs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.InputStatuses(), a.Logger)
+	})
+	mux.HandleFunc("/api/v1/outputs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.OutputStatuses(), a.Logger)
+	})
+	mux.HandleFunc("/api/v1/config", func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := a.Config.Redacted()
+		if err != nil {
+			level.Warn(a.Logger).Log("msg", "redact_config_failed", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, cfg, a.Logger)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, logger log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	// the redacted secrets are readable as <secret>
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		level.Warn(logger).Log("msg", "encode_api_failed", "error", err)
+	}
+}
@@ -16,6 +16,7 @@ package server
 
 import (
 	"sync"
+	"time"
 )
 
 type result struct {
@@ -24,6 +25,7 @@ type result struct {
 	target      string
 	debugOutput string
 	success     bool
+	time        time.Time
 }
 
 // resultHistory contains two history slices: `results` contains most recent `maxResults` results.
@@ -48,6 +50,7 @@ func (rh *resultHistory) Add(moduleName, target, debugOutput string, success boo
 		target:      target,
 		debugOutput: debugOutput,
 		success:     success,
+		time:        time.Now(),
 	}
 	rh.nextId++
 
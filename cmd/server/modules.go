@@ -0,0 +1,249 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/blackbox_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+	"trellis.tech/kolekti/prome_exporters/conf"
+)
+
+const defaultWatchInterval = 10 * time.Second
+
+var (
+	modulesReloadSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "blackbox_modules_last_reload_successful",
+		Help: "Blackbox modules loaded successfully.",
+	})
+	modulesReloadSecondsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "blackbox_modules_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful modules reload.",
+	})
+)
+
+// modules holds the modules of the probes, they are loaded from the modules_file if set,
+// which is reloaded atomically: an invalid file keeps the modules loaded before
+type modules struct {
+	sc     *config.SafeConfig
+	file   string
+	logger log.Logger
+
+	// mu serializes the reloads of the watcher and /-/reload
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+
+	stopChan chan struct{}
+}
+
+func newModules(cfg conf.BlackboxProbeConfig, logger log.Logger) (*modules, error) {
+	p := &modules{
+		sc:     &config.SafeConfig{C: &config.Config{}},
+		file:   cfg.ModulesFile,
+		logger: logger,
+	}
+
+	if p.file == "" {
+		if cfg.Modules != nil {
+			// the modules of exporters.yaml are checked by blackbox_exporter when decoded, they are
+			// not marshaled again, which masks the secrets of them
+			if err := checkProbers(cfg.Modules); err != nil {
+				return nil, err
+			}
+			p.sc = &config.SafeConfig{C: cfg.Modules}
+		}
+		// the inline modules are loaded once
+		modulesReloadSuccessGauge.Set(1)
+		modulesReloadSecondsGauge.SetToCurrentTime()
+		return p, nil
+	}
+
+	if cfg.Modules != nil && len(cfg.Modules.Modules) > 0 {
+		return nil, fmt.Errorf("at most one of modules and modules_file can be set")
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	interval := defaultWatchInterval
+	if cfg.WatchInterval > 0 {
+		interval = time.Duration(cfg.WatchInterval)
+	}
+	p.stopChan = make(chan struct{})
+	go p.watch(p.newWatcher(), interval)
+	return p, nil
+}
+
+// Get returns the modules loaded
+func (p *modules) Get() *config.Config {
+	p.sc.RLock()
+	defer p.sc.RUnlock()
+	return p.sc.C
+}
+
+// Reload loads the modules_file, the modules are replaced only if all of them are valid
+func (p *modules) Reload() (err error) {
+	if p.file == "" {
+		return fmt.Errorf("modules_file is not set")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	defer func() {
+		if err != nil {
+			modulesReloadSuccessGauge.Set(0)
+			level.Error(p.logger).Log("msg", "reload_modules_failed", "file", p.file, "error", err)
+			return
+		}
+		modulesReloadSuccessGauge.Set(1)
+		modulesReloadSecondsGauge.SetToCurrentTime()
+		level.Info(p.logger).Log("msg", "reload_modules", "file", p.file)
+	}()
+
+	fi, err := os.Stat(p.file)
+	if err != nil {
+		return err
+	}
+	bs, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+	// the file is not read again by the watcher until it is changed, even if it is invalid
+	p.modTime, p.size = fi.ModTime(), fi.Size()
+
+	c, err := parseModules(bs)
+	if err != nil {
+		return fmt.Errorf("invalid modules_file %s: %w", p.file, err)
+	}
+
+	p.sc.Lock()
+	p.sc.C = c
+	p.sc.Unlock()
+	return nil
+}
+
+// Stop stops watching the modules_file
+func (p *modules) Stop() {
+	if p.stopChan != nil {
+		close(p.stopChan)
+		p.stopChan = nil
+	}
+}
+
+// newWatcher watches the directory of the modules_file, so that the file replaced by a rename
+// is watched too, it returns nil if the directory can't be watched
+func (p *modules) newWatcher() *fsnotify.Watcher {
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = w.Add(filepath.Dir(p.file)); err != nil {
+			w.Close()
+		}
+	}
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "watch_modules_file_failed", "file", p.file, "error", err)
+		return nil
+	}
+	return w
+}
+
+// watch reloads the modules_file when it is changed, by the events of the watcher, and by checking
+// its modification time and size at the interval as the fallback of the events missed, such as the
+// changes of a file on NFS, or of all the changes if the watcher is nil
+func (p *modules) watch(w *fsnotify.Watcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	if w != nil {
+		defer w.Close()
+		events, errs = w.Events, w.Errors
+	}
+
+	file := filepath.Clean(p.file)
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.reloadChanged()
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(event.Name) == file {
+				p.reloadChanged()
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			level.Warn(p.logger).Log("msg", "watch_modules_file_failed", "file", p.file, "error", err)
+		}
+	}
+}
+
+// reloadChanged reloads the modules_file if its modification time or size is changed
+func (p *modules) reloadChanged() {
+	fi, err := os.Stat(p.file)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "stat_modules_file_failed", "file", p.file, "error", err)
+		return
+	}
+	p.mu.Lock()
+	changed := !fi.ModTime().Equal(p.modTime) || fi.Size() != p.size
+	p.mu.Unlock()
+	if changed {
+		_ = p.Reload()
+	}
+}
+
+// parseModules parses the modules by the checks of blackbox_exporter, and checks the probers of them
+func parseModules(bs []byte) (*config.Config, error) {
+	c := &config.Config{}
+	if err := yaml.UnmarshalStrict(bs, c); err != nil {
+		return nil, err
+	}
+	if err := checkProbers(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkProbers checks the probers of the modules are supported
+func checkProbers(c *config.Config) error {
+	for name, module := range c.Modules {
+		if _, ok := Probers[module.Prober]; !ok {
+			return fmt.Errorf("unknown prober %q of the module %s", module.Prober, name)
+		}
+	}
+	return nil
+}
@@ -26,21 +26,16 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/blackbox_exporter/config"
-	"github.com/prometheus/blackbox_exporter/prober"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/expfmt"
 	"gopkg.in/yaml.v2"
+	"trellis.tech/kolekti/prome_exporters/plugins/inputs/blackbox"
 )
 
 var (
-	Probers = map[string]prober.ProbeFn{
-		"http": prober.ProbeHTTP,
-		"tcp":  prober.ProbeTCP,
-		"icmp": prober.ProbeICMP,
-		"dns":  prober.ProbeDNS,
-		"grpc": prober.ProbeGRPC,
-	}
+	// Probers are shared with the blackbox input
+	Probers = blackbox.Probers
 
 	moduleUnknownCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "blackbox_module_unknown_total",
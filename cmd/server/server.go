@@ -15,8 +15,13 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package server
 
 import (
+	"context"
 	stdlog "log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -27,8 +32,11 @@ import (
 	"github.com/prometheus/exporter-toolkit/web"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"trellis.tech/kolekti/prome_exporters/agent"
+	"trellis.tech/kolekti/prome_exporters/plugins/inputs/blackbox"
 )
 
+const shutdownTimeout = 5 * time.Second
+
 var (
 	metricsPath            *string
 	listenAddress          *string
@@ -73,6 +81,20 @@ func init() {
 
 func Run(a *agent.Agent) int {
 
+	// the modules of blackbox_probe are loaded before the agent, the blackbox inputs without modules use them
+	var ms *modules
+	if probeConfig := a.Config.Exporter.BlackboxProbe; probeConfig.Open || probeConfig.ModulesFile != "" ||
+		(probeConfig.Modules != nil && len(probeConfig.Modules.Modules) > 0) {
+		var err error
+		ms, err = newModules(probeConfig, log.With(a.Logger, "component", "modules"))
+		if err != nil {
+			level.Error(a.Logger).Log("msg", "load_blackbox_modules_failed", "error", err)
+			return 3
+		}
+		defer ms.Stop()
+		blackbox.SharedModules = ms.Get
+	}
+
 	if err := a.Run(); err != nil {
 		level.Error(a.Logger).Log("failed_run_agent", a.Config, "error", err)
 		return 3
@@ -99,30 +121,60 @@ func Run(a *agent.Agent) int {
 	}
 
 	http.Handle(*metricsPath, h)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>Node Exporter</title></head>
-			<body>
-			<h1>Node Exporter</h1>
-			<p><a href="` + *metricsPath + `">Metrics</a></p>
-			</body>
-			</html>`))
-	})
+	registerAPI(http.DefaultServeMux, a)
+
+	if ms != nil {
+		reg.MustRegister(modulesReloadSuccessGauge, modulesReloadSecondsGauge)
+	}
 
+	// rh is nil if the probe api is not open, then the index shows the metrics only
+	var rh *resultHistory
 	if a.Config.Exporter.BlackboxProbe.Open {
 		level.Info(a.Logger).Log("msg", "probe api open")
 
-		rh := &resultHistory{maxResults: *historyLimit}
+		rh = &resultHistory{maxResults: *historyLimit}
 
 		http.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
-			probeHandler(w, r, a.Config.Exporter.BlackboxProbe.Modules, a.Logger, rh)
+			probeHandler(w, r, ms.Get(), a.Logger, rh)
+		})
+		http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+			logsHandler(w, r, rh)
+		})
+		http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+			configHandler(w, ms.Get(), a.Logger)
+		})
+		http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			reloadHandler(w, r, ms)
+		})
+		http.HandleFunc("/api/v1/probes", func(w http.ResponseWriter, r *http.Request) {
+			probesHandler(w, r, rh, a.Logger)
 		})
-
 	}
 
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		indexHandler(w, rh)
+	})
+
 	level.Info(a.Logger).Log("msg", "Listening on", "address", *listenAddress)
 	server := &http.Server{Addr: *listenAddress}
-	if err := web.ListenAndServe(server, *webConfig, a.Logger); err != nil {
+
+	// the server is shut down by the signals, then the agent is stopped, so the outputs are closed
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			level.Error(a.Logger).Log("msg", "shutdown_server_failed", "error", err)
+		}
+	}()
+
+	if err := web.ListenAndServe(server, *webConfig, a.Logger); err != nil && err != http.ErrServerClosed {
 		level.Error(a.Logger).Log("err", err)
 		return 1
 	}
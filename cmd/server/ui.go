@@ -0,0 +1,161 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/blackbox_exporter/config"
+	"gopkg.in/yaml.v2"
+)
+
+// probeResult is a result of the history in the api
+type probeResult struct {
+	ID          int64     `json:"id"`
+	Module      string    `json:"module"`
+	Target      string    `json:"target"`
+	Success     bool      `json:"success"`
+	Time        time.Time `json:"time"`
+	DebugOutput string    `json:"debug_output,omitempty"`
+}
+
+func newProbeResult(r *result, debug bool) *probeResult {
+	pr := &probeResult{
+		ID:      r.id,
+		Module:  r.moduleName,
+		Target:  r.target,
+		Success: r.success,
+		Time:    r.time,
+	}
+	if debug {
+		pr.DebugOutput = r.debugOutput
+	}
+	return pr
+}
+
+// indexHandler shows the links and the recent probes, the newest first, if the probe api is open
+func indexHandler(w http.ResponseWriter, rh *resultHistory) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<html>
+<head><title>Prome Exporters</title></head>
+<body>
+<h1>Prome Exporters</h1>
+<p><a href="` + html.EscapeString(*metricsPath) + `">Metrics</a></p>
+`)
+
+	if rh != nil {
+		buf.WriteString(`<form action="probe">
+<label>Target:</label> <input type="text" name="target" placeholder="X.X.X.X" value="prometheus.io">
+<label>Module:</label> <input type="text" name="module" placeholder="module" value="http_2xx">
+<input type="submit" value="Submit">
+</form>
+<p><a href="config">Configuration</a></p>
+<p><a href="api/v1/probes">Probes API</a></p>
+<h2>Recent Probes</h2>
+<table border="1"><tr><th>Module</th><th>Target</th><th>Time</th><th>Result</th><th>Debug</th></tr>
+`)
+		results := rh.List()
+		for i := len(results) - 1; i >= 0; i-- {
+			r := results[i]
+			success := "Success"
+			if !r.success {
+				success = "<strong>Failure</strong>"
+			}
+			fmt.Fprintf(buf, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td><a href='logs?id=%d'>Logs</a></td></tr>\n",
+				html.EscapeString(r.moduleName), html.EscapeString(r.target), r.time.Format(time.RFC3339), success, r.id)
+		}
+		buf.WriteString("</table>\n")
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// logsHandler shows the debug output of the probe of the id
+func logsHandler(w http.ResponseWriter, r *http.Request, rh *resultHistory) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid probe id", http.StatusBadRequest)
+		return
+	}
+	result := rh.Get(id)
+	if result == nil {
+		http.Error(w, "Probe id not present", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(result.debugOutput))
+}
+
+// configHandler shows the modules of the probes in yaml
+func configHandler(w http.ResponseWriter, c *config.Config, logger log.Logger) {
+	bs, err := yaml.Marshal(c)
+	if err != nil {
+		level.Warn(logger).Log("msg", "marshal_modules_failed", "error", err)
+		http.Error(w, fmt.Sprintf("Error marshaling configuration: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(bs)
+}
+
+// reloadHandler reloads the modules_file, the modules loaded before are kept if it fails
+func reloadHandler(w http.ResponseWriter, r *http.Request, ms *modules) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "This endpoint requires a POST or PUT request.\n")
+		return
+	}
+	if err := ms.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload modules: %s", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "modules reloaded\n")
+}
+
+// probesHandler returns the recent probes in json, the newest first, or the probe of the id with its debug output
+func probesHandler(w http.ResponseWriter, r *http.Request, rh *resultHistory, logger log.Logger) {
+	var v interface{}
+	if idStr := r.URL.Query().Get("id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid probe id", http.StatusBadRequest)
+			return
+		}
+		result := rh.Get(id)
+		if result == nil {
+			http.Error(w, "Probe id not present", http.StatusNotFound)
+			return
+		}
+		v = newProbeResult(result, true)
+	} else {
+		results := rh.List()
+		probes := make([]*probeResult, 0, len(results))
+		for i := len(results) - 1; i >= 0; i-- {
+			probes = append(probes, newProbeResult(results[i], false))
+		}
+		v = probes
+	}
+
+	writeJSON(w, v, logger)
+}
@@ -15,6 +15,10 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package conf
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+
 	beConfig "github.com/prometheus/blackbox_exporter/config"
 	"trellis.tech/trellis/common.v1/config"
 	"trellis.tech/trellis/common.v1/types"
@@ -25,6 +29,9 @@ type Config struct {
 
 	Inputs []*InputsConfig `yaml:"inputs" json:"inputs"`
 	Output *OutputConfig   `yaml:"output" json:"output"`
+
+	// hash is the sha256 of the config file
+	hash string
 }
 
 type ExporterConfig struct {
@@ -33,6 +40,8 @@ type ExporterConfig struct {
 
 	GlobalTags map[string]string `yaml:"global_tags" json:"global_tags"`
 
+	Host HostConfig `yaml:"host" json:"host"`
+
 	FlushInterval     types.Duration `yaml:"flush_interval" json:"flush_interval"`
 	MetricBufferLimit int64          `yaml:"metric_buffer_limit" json:"metric_buffer_limit"`
 	MetricBatchSize   int64          `yaml:"metric_batch_size" json:"metric_batch_size"`
@@ -40,9 +49,30 @@ type ExporterConfig struct {
 	BlackboxProbe BlackboxProbeConfig `yaml:"blackbox_probe" json:"blackbox_probe"`
 }
 
+// HostConfig is the identity of the host which is resolved once by the agent
+type HostConfig struct {
+	// Source is one of hostname, fqdn, interface, ipv4, ipv6, static, defaults ipv4, which falls back to
+	// the hostname if the host has no ipv4 address
+	Source string `yaml:"source" json:"source"`
+	// Interface is the name of the interface for the source interface
+	Interface string `yaml:"interface" json:"interface"`
+	// IPv6 uses the ipv6 address of the interface
+	IPv6 bool `yaml:"ipv6" json:"ipv6"`
+	// Value is the identity for the source static
+	Value string `yaml:"value" json:"value"`
+	// Label adds the identity to all the metrics with the label name if not empty
+	Label string `yaml:"label" json:"label"`
+}
+
 type BlackboxProbeConfig struct {
 	Open    bool             `yaml:"open" json:"open"`
 	Modules *beConfig.Config `yaml:",inline" json:",inline"`
+	// ModulesFile is a file of the modules instead of the modules, it is reloaded when it is changed
+	// or /-/reload is requested, an invalid file keeps the modules loaded before
+	ModulesFile string `yaml:"modules_file" json:"modules_file"`
+	// WatchInterval is the interval checking the changes of the modules file besides watching it with
+	// fsnotify, which may miss the changes such as on NFS, defaults 10s
+	WatchInterval types.Duration `yaml:"watch_interval" json:"watch_interval"`
 }
 
 type InputsConfig struct {
@@ -63,7 +93,17 @@ func (p *Config) check() error {
 	return nil
 }
 
+// Hash returns the sha256 of the config file, which is empty if the config is not read from a file
+func (p *Config) Hash() string {
+	return p.hash
+}
+
 func GetConfigWithFile(filename string) (*Config, error) {
+	// the file is hashed as it is, the config marshaled again has the secrets masked
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
 	c, err := config.NewConfig(filename)
 	if err != nil {
 		return nil, err
@@ -76,5 +116,7 @@ func GetConfigWithFile(filename string) (*Config, error) {
 	if err = ec.check(); err != nil {
 		return nil, err
 	}
+	sum := sha256.Sum256(bs)
+	ec.hash = hex.EncodeToString(sum[:])
 	return ec, nil
 }
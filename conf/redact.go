@@ -0,0 +1,156 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const secretValue = "<secret>"
+
+// redactedURLValue replaces the passwords and the query parameter values of the urls, the same
+// as url.URL.Redacted
+const redactedURLValue = "xxxxx"
+
+// secretKeyRE matches the keys of the secrets, such as api_key and X-Api-Key, the keys ending
+// with _file or _url are the paths of the secrets and the urls getting them
+var secretKeyRE = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|private[_-]?key|api[_-]?key|access[_-]?key)`)
+
+// valuesKeys are the keys of the maps all the values of which are redacted, as any header such
+// as Authorization, endpoint param of oauth2 or environment variable of exec may be a secret
+var valuesKeys = map[string]bool{"headers": true, "endpoint_params": true, "env": true}
+
+// secretKeys are the keys redacted besides the ones matching secretKeyRE, the body of the http
+// input targets may carry the credentials of a login
+var secretKeys = map[string]bool{"body": true}
+
+// MarshalYAML flattens the modules as they are inlined, yaml can't inline a pointer
+func (p BlackboxProbeConfig) MarshalYAML() (interface{}, error) {
+	m := map[string]interface{}{
+		"open":           p.Open,
+		"modules_file":   p.ModulesFile,
+		"watch_interval": p.WatchInterval,
+	}
+	if p.Modules != nil {
+		m["modules"] = p.Modules.Modules
+	}
+	return m, nil
+}
+
+// Redacted returns the config with the secrets redacted, the values of the secret keys, the
+// headers, endpoint_params and env are replaced by "<secret>", the passwords and the query
+// parameter values of the urls by "xxxxx"
+func (p *Config) Redacted() (map[string]interface{}, error) {
+	bs, err := yaml.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(bs, &v); err != nil {
+		return nil, err
+	}
+	m, ok := redact(v).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected config of %T", v)
+	}
+	return m, nil
+}
+
+// redact redacts the secrets of the value decoded from yaml, the maps are converted to map[string]interface{}
+func redact(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			key := fmt.Sprint(k)
+			if isSecretKey(key) && item != nil && item != "" {
+				m[key] = secretValue
+				continue
+			}
+			if values, ok := item.(map[interface{}]interface{}); ok && valuesKeys[strings.ToLower(key)] {
+				m[key] = redactValues(values)
+				continue
+			}
+			m[key] = redact(item)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = redact(item)
+		}
+		return items
+	case string:
+		return redactURL(value)
+	}
+	return v
+}
+
+// redactValues redacts all the values of the map which are not empty
+func redactValues(value map[interface{}]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(value))
+	for k, item := range value {
+		if item != nil && item != "" {
+			item = secretValue
+		}
+		m[fmt.Sprint(k)] = item
+	}
+	return m
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if secretKeys[key] {
+		return true
+	}
+	return secretKeyRE.MatchString(key) && !strings.HasSuffix(key, "_file") && !strings.HasSuffix(key, "_url")
+}
+
+// redactURL redacts the password of an url the same as the url labels of the http input, and
+// the values of the query parameters, such as the tokens of ?api_key=
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	_, hasPassword := u.User.Password()
+	if !hasPassword && u.RawQuery == "" {
+		return s
+	}
+	if u.RawQuery != "" {
+		query, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			// the query can't be parsed is redacted as a whole
+			u.RawQuery = redactedURLValue
+		} else {
+			for k, values := range query {
+				for i := range values {
+					values[i] = redactedURLValue
+				}
+				query[k] = values
+			}
+			u.RawQuery = query.Encode()
+		}
+	}
+	return u.Redacted()
+}
@@ -3,7 +3,9 @@ module trellis.tech/kolekti/prome_exporters
 go 1.16
 
 require (
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/go-kit/log v0.2.0
+	github.com/klauspost/compress v1.15.9
 	github.com/matttproud/golang_protobuf_extensions v1.0.1
 	github.com/prometheus/blackbox_exporter v0.20.0
 	github.com/prometheus/client_golang v1.12.1
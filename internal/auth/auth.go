@@ -0,0 +1,151 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the authentication of http requests shared by the http input and
+// outputs. At most one of basic auth, bearer token, oauth2 and sigv4 can be set.
+type Config struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+
+	BearerToken string `yaml:"bearer_token" json:"bearer_token"`
+	// BearerTokenFile is read again when it's modified
+	BearerTokenFile string `yaml:"bearer_token_file" json:"bearer_token_file"`
+
+	OAuth2 *OAuth2Config `yaml:"oauth2" json:"oauth2"`
+	SigV4  *SigV4Config  `yaml:"sigv4" json:"sigv4"`
+}
+
+func (p *Config) check() error {
+	var methods []string
+	if p.Username != "" || p.Password != "" {
+		methods = append(methods, "basic auth")
+	}
+	if p.BearerToken != "" || p.BearerTokenFile != "" {
+		methods = append(methods, "bearer token")
+	}
+	if p.BearerToken != "" && p.BearerTokenFile != "" {
+		return fmt.Errorf("at most one of bearer_token and bearer_token_file can be set")
+	}
+	if p.OAuth2 != nil {
+		methods = append(methods, "oauth2")
+	}
+	if p.SigV4 != nil {
+		methods = append(methods, "sigv4")
+	}
+	if len(methods) > 1 {
+		return fmt.Errorf("at most one of the authentications can be set: %s", strings.Join(methods, ", "))
+	}
+	return nil
+}
+
+// NewRoundTripper returns a http.RoundTripper which authenticates the requests
+// sent with next, next itself is returned when no authentication is set.
+func (p *Config) NewRoundTripper(next http.RoundTripper) (http.RoundTripper, error) {
+	if p == nil {
+		return next, nil
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.Username != "" || p.Password != "":
+		return &basicAuthRoundTripper{username: p.Username, password: p.Password, next: next}, nil
+	case p.BearerToken != "":
+		return &bearerRoundTripper{token: staticToken(p.BearerToken), next: next}, nil
+	case p.BearerTokenFile != "":
+		return &bearerRoundTripper{token: (&fileToken{filename: p.BearerTokenFile}).Token, next: next}, nil
+	case p.OAuth2 != nil:
+		return newOAuth2RoundTripper(p.OAuth2, next)
+	case p.SigV4 != nil:
+		return newSigV4RoundTripper(p.SigV4, next)
+	}
+	return next, nil
+}
+
+type basicAuthRoundTripper struct {
+	username, password string
+	next               http.RoundTripper
+}
+
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(rt.username, rt.password)
+	return rt.next.RoundTrip(req)
+}
+
+type bearerRoundTripper struct {
+	token func() (string, error)
+	next  http.RoundTripper
+}
+
+func (rt *bearerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.token()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return rt.next.RoundTrip(req)
+}
+
+func staticToken(token string) func() (string, error) {
+	return func() (string, error) {
+		return token, nil
+	}
+}
+
+// fileToken caches the token of the file until the file is modified
+type fileToken struct {
+	filename string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func (p *fileToken) Token() (string, error) {
+	fi, err := os.Stat(p.filename)
+	if err != nil {
+		return "", fmt.Errorf("unable to read bearer token file %s: %v", p.filename, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && fi.ModTime().Equal(p.modTime) && fi.Size() == p.size {
+		return p.token, nil
+	}
+
+	bs, err := os.ReadFile(p.filename)
+	if err != nil {
+		return "", fmt.Errorf("unable to read bearer token file %s: %v", p.filename, err)
+	}
+	p.token = strings.TrimSpace(string(bs))
+	p.modTime = fi.ModTime()
+	p.size = fi.Size()
+	return p.token, nil
+}
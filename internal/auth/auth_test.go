@@ -0,0 +1,92 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// authServer responds the authorization header of the requests
+func authServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+}
+
+func getAuthorization(t *testing.T, rt http.RoundTripper, u string) string {
+	t.Helper()
+	resp, err := (&http.Client{Transport: rt}).Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestBearerTokenFile(t *testing.T) {
+	ts := authServer()
+	defer ts.Close()
+
+	filename := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(filename, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := (&Config{BearerTokenFile: filename}).NewRoundTripper(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth := getAuthorization(t, rt, ts.URL); auth != "Bearer first" {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+	// the file modified is read again
+	if err := ioutil.WriteFile(filename, []byte("second-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if auth := getAuthorization(t, rt, ts.URL); auth != "Bearer second-token" {
+		t.Errorf("unexpected authorization %q after the file modified", auth)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	for _, cfg := range []*Config{
+		{Username: "u", BearerToken: "t"},
+		{BearerToken: "t", BearerTokenFile: "f"},
+		{BearerToken: "t", OAuth2: &OAuth2Config{ClientID: "c", TokenURL: "http://127.0.0.1/token"}},
+		{Password: "p", SigV4: &SigV4Config{Region: "us-east-1", AccessKey: "a", SecretKey: "s"}},
+	} {
+		if _, err := cfg.NewRoundTripper(http.DefaultTransport); err == nil {
+			t.Errorf("expected the error of %+v", cfg)
+		}
+	}
+
+	ts := authServer()
+	defer ts.Close()
+	rt, err := (&Config{Username: "u", Password: "p"}).NewRoundTripper(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := getAuthorization(t, rt, ts.URL); auth != "Basic dTpw" {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+}
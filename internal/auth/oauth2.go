@@ -0,0 +1,153 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxErrMsgLen = 1024
+	// refreshes the token before it expires
+	tokenExpirySkew = 10 * time.Second
+)
+
+// OAuth2Config is the oauth2 client credentials flow
+type OAuth2Config struct {
+	ClientID         string            `yaml:"client_id" json:"client_id"`
+	ClientSecret     string            `yaml:"client_secret" json:"client_secret"`
+	ClientSecretFile string            `yaml:"client_secret_file" json:"client_secret_file"`
+	TokenURL         string            `yaml:"token_url" json:"token_url"`
+	Scopes           []string          `yaml:"scopes" json:"scopes"`
+	EndpointParams   map[string]string `yaml:"endpoint_params" json:"endpoint_params"`
+}
+
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// oauth2RoundTripper caches the access token until it expires
+type oauth2RoundTripper struct {
+	cfg  *OAuth2Config
+	next http.RoundTripper
+
+	mu        sync.Mutex
+	token     string
+	tokenType string
+	expiry    time.Time
+}
+
+func newOAuth2RoundTripper(cfg *OAuth2Config, next http.RoundTripper) (http.RoundTripper, error) {
+	if cfg.ClientID == "" || cfg.TokenURL == "" {
+		return nil, fmt.Errorf("oauth2 client_id and token_url are required")
+	}
+	if cfg.ClientSecret != "" && cfg.ClientSecretFile != "" {
+		return nil, fmt.Errorf("at most one of oauth2 client_secret and client_secret_file can be set")
+	}
+	if _, err := url.Parse(cfg.TokenURL); err != nil {
+		return nil, err
+	}
+	return &oauth2RoundTripper{cfg: cfg, next: next}, nil
+}
+
+func (rt *oauth2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tokenType, token, err := rt.getToken(req)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", tokenType+" "+token)
+	return rt.next.RoundTrip(req)
+}
+
+func (rt *oauth2RoundTripper) getToken(origin *http.Request) (string, string, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.token != "" && (rt.expiry.IsZero() || time.Now().Add(tokenExpirySkew).Before(rt.expiry)) {
+		return rt.tokenType, rt.token, nil
+	}
+
+	secret := rt.cfg.ClientSecret
+	if rt.cfg.ClientSecretFile != "" {
+		bs, err := os.ReadFile(rt.cfg.ClientSecretFile)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read oauth2 client secret file %s: %v", rt.cfg.ClientSecretFile, err)
+		}
+		secret = strings.TrimSpace(string(bs))
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "client_credentials")
+	if len(rt.cfg.Scopes) > 0 {
+		params.Set("scope", strings.Join(rt.cfg.Scopes, " "))
+	}
+	for k, v := range rt.cfg.EndpointParams {
+		params.Set(k, v)
+	}
+
+	req, err := http.NewRequestWithContext(origin.Context(), http.MethodPost, rt.cfg.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(rt.cfg.ClientID), url.QueryEscape(secret))
+
+	now := time.Now()
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return "", "", fmt.Errorf("oauth2 token request [%s] failed: %v", rt.cfg.TokenURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorLine := ""
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
+		if scanner.Scan() {
+			errorLine = scanner.Text()
+		}
+		return "", "", fmt.Errorf("oauth2 token request [%s] received status code: %d. body: %s", rt.cfg.TokenURL, resp.StatusCode, errorLine)
+	}
+
+	token := &oauth2Token{}
+	if err = json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return "", "", fmt.Errorf("oauth2 token response [%s] is invalid: %v", rt.cfg.TokenURL, err)
+	}
+	if token.AccessToken == "" {
+		return "", "", fmt.Errorf("oauth2 token response [%s] has no access_token", rt.cfg.TokenURL)
+	}
+
+	rt.token = token.AccessToken
+	rt.tokenType = "Bearer"
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		rt.tokenType = token.TokenType
+	}
+	rt.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		rt.expiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return rt.tokenType, rt.token, nil
+}
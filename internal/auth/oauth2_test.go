@@ -0,0 +1,138 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// tokenServer issues the tokens "token-<n>" expiring in expiresIn seconds, and records the forms requested
+type tokenServer struct {
+	*httptest.Server
+	expiresIn int
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newTokenServer(t *testing.T, expiresIn int) *tokenServer {
+	s := &tokenServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		n := len(s.requests)
+		s.mu.Unlock()
+
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "secret" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, n, s.expiresIn)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tokenServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func TestOAuth2TokenCached(t *testing.T) {
+	tokens := newTokenServer(t, 3600)
+	ts := authServer()
+	defer ts.Close()
+
+	rt, err := (&Config{OAuth2: &OAuth2Config{
+		ClientID:       "client",
+		ClientSecret:   "secret",
+		TokenURL:       tokens.URL,
+		Scopes:         []string{"read", "write"},
+		EndpointParams: map[string]string{"audience": "metrics"},
+	}}).NewRoundTripper(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if auth := getAuthorization(t, rt, ts.URL); auth != "Bearer token-1" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+	}
+	if n := tokens.count(); n != 1 {
+		t.Fatalf("unexpected token requests %d, expected the token cached", n)
+	}
+
+	form := tokens.requests[0].PostForm
+	if form.Get("grant_type") != "client_credentials" || form.Get("scope") != "read write" || form.Get("audience") != "metrics" {
+		t.Errorf("unexpected form of the token request: %v", form)
+	}
+}
+
+func TestOAuth2TokenRefreshed(t *testing.T) {
+	// the token expiring within tokenExpirySkew is requested again
+	tokens := newTokenServer(t, 1)
+	ts := authServer()
+	defer ts.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := (&Config{OAuth2: &OAuth2Config{
+		ClientID:         "client",
+		ClientSecretFile: secretFile,
+		TokenURL:         tokens.URL,
+	}}).NewRoundTripper(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if auth, expected := getAuthorization(t, rt, ts.URL), fmt.Sprintf("Bearer token-%d", i); auth != expected {
+			t.Errorf("unexpected authorization %q, expected %q", auth, expected)
+		}
+	}
+}
+
+func TestOAuth2TokenFailed(t *testing.T) {
+	tokens := newTokenServer(t, 3600)
+	rt, err := (&Config{OAuth2: &OAuth2Config{
+		ClientID:     "client",
+		ClientSecret: "wrong",
+		TokenURL:     tokens.URL,
+	}}).NewRoundTripper(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, tokens.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Errorf("expected the error of the token request")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat     = "20060102T150405Z"
+	sigV4DateFormat     = "20060102"
+	defaultSigV4Service = "aps"
+)
+
+// SigV4Config signs the requests with AWS signature version 4, the credentials
+// default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+// the region to AWS_REGION.
+type SigV4Config struct {
+	Region       string `yaml:"region" json:"region"`
+	AccessKey    string `yaml:"access_key" json:"access_key"`
+	SecretKey    string `yaml:"secret_key" json:"secret_key"`
+	SessionToken string `yaml:"session_token" json:"session_token"`
+	// Service defaults aps, the amazon managed service for prometheus
+	Service string `yaml:"service" json:"service"`
+}
+
+type sigV4RoundTripper struct {
+	region, accessKey, secretKey, sessionToken, service string
+
+	next http.RoundTripper
+	now  func() time.Time
+}
+
+func newSigV4RoundTripper(cfg *SigV4Config, next http.RoundTripper) (http.RoundTripper, error) {
+	rt := &sigV4RoundTripper{
+		region:       cfg.Region,
+		accessKey:    cfg.AccessKey,
+		secretKey:    cfg.SecretKey,
+		sessionToken: cfg.SessionToken,
+		service:      cfg.Service,
+		next:         next,
+		now:          time.Now,
+	}
+	if rt.region == "" {
+		rt.region = os.Getenv("AWS_REGION")
+	}
+	if rt.accessKey == "" && rt.secretKey == "" {
+		rt.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		rt.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		rt.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if rt.service == "" {
+		rt.service = defaultSigV4Service
+	}
+	if rt.region == "" {
+		return nil, fmt.Errorf("sigv4 region is required")
+	}
+	if rt.accessKey == "" || rt.secretKey == "" {
+		return nil, fmt.Errorf("sigv4 access_key and secret_key are required")
+	}
+	return rt, nil
+}
+
+func (rt *sigV4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	rt.sign(req, body)
+	return rt.next.RoundTrip(req)
+}
+
+func (rt *sigV4RoundTripper) sign(req *http.Request, body []byte) {
+	now := rt.now().UTC()
+	amzDate := now.Format(sigV4TimeFormat)
+	date := now.Format(sigV4DateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if rt.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", rt.sessionToken)
+	}
+
+	canonicalRequest, signedHeaders := sigV4CanonicalRequest(req, hashHex(body))
+	scope := strings.Join([]string{date, rt.region, rt.service, "aws4_request"}, "/")
+	stringToSign := sigV4StringToSign(amzDate, scope, canonicalRequest)
+	signature := hex.EncodeToString(hmacSHA256(rt.signingKey(date), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, rt.accessKey, scope, signedHeaders, signature))
+}
+
+// sigV4CanonicalRequest returns the canonical request and the signed headers, which are the host,
+// the content type and the x-amz headers set by the signer
+func sigV4CanonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for _, name := range []string{"Content-Type", "X-Amz-Date", "X-Amz-Security-Token"} {
+		if v := req.Header.Get(name); v != "" {
+			headers[strings.ToLower(name)] = strings.TrimSpace(v)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	return strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+func sigV4StringToSign(amzDate, scope, canonicalRequest string) string {
+	return strings.Join([]string{sigV4Algorithm, amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+}
+
+// signingKey derives the key of the date, the region and the service from the secret key
+func (rt *sigV4RoundTripper) signingKey(date string) []byte {
+	key := hmacSHA256([]byte("AWS4"+rt.secretKey), date)
+	key = hmacSHA256(key, rt.region)
+	key = hmacSHA256(key, rt.service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// canonicalPath encodes each segment of the path twice as the services other than s3 expect
+func canonicalPath(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		vs := append([]string(nil), values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes all the characters except the unreserved ones of RFC 3986
+func uriEncode(s string) string {
+	buf := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+func hashHex(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the vectors of the aws signature version 4 test suite, signed by the credentials of the suite
+// with the region us-east-1 and the service "service" at 20150830T123600Z
+var sigV4Vectors = []struct {
+	name             string
+	method, url      string
+	contentType      string
+	body             string
+	canonicalRequest string
+	stringToSign     string
+	authorization    string
+}{
+	{
+		name:   "get-vanilla",
+		method: http.MethodGet,
+		url:    "https://example.amazonaws.com/",
+		canonicalRequest: "GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		stringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+			"bb579772317eb040ac9ed261061d46c1f17a8133879d6129b6e1c25292927e63",
+		authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+	},
+	{
+		name:   "get-vanilla-query-order-key-case",
+		method: http.MethodGet,
+		url:    "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+		canonicalRequest: "GET\n/\nParam1=value1&Param2=value2\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\n" +
+			"host;x-amz-date\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		stringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+			"816cd5b414d056048ba4f7c5386d6e0533120fb1fcfa93762cf0fc39e2cf19e0",
+		authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	},
+	{
+		name:   "post-vanilla",
+		method: http.MethodPost,
+		url:    "https://example.amazonaws.com/",
+		canonicalRequest: "POST\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" +
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		stringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+			"553f88c9e4d10fc9e109e2aeb65f030801b70c2f6468faca261d401ae622fc87",
+		authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+	},
+	{
+		name:        "post-x-www-form-urlencoded",
+		method:      http.MethodPost,
+		url:         "https://example.amazonaws.com/",
+		contentType: "application/x-www-form-urlencoded",
+		body:        "Param1=value1",
+		canonicalRequest: "POST\n/\n\ncontent-type:application/x-www-form-urlencoded\nhost:example.amazonaws.com\n" +
+			"x-amz-date:20150830T123600Z\n\ncontent-type;host;x-amz-date\n" +
+			"9095672bbd1f56dfc5b65f3e153adc8731a4a654192329106275f4c7b24d0b6e",
+		stringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n20150830/us-east-1/service/aws4_request\n" +
+			"42a5e5bb34198acb3e84da4f085bb7927f2bc277ca766e6d19c73c2154021281",
+		authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+	},
+}
+
+func newTestSigV4RoundTripper(t *testing.T, sessionToken string, next http.RoundTripper) *sigV4RoundTripper {
+	rt, err := newSigV4RoundTripper(&SigV4Config{
+		Region:       "us-east-1",
+		AccessKey:    "AKIDEXAMPLE",
+		SecretKey:    "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken: sessionToken,
+		Service:      "service",
+	}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigV4 := rt.(*sigV4RoundTripper)
+	sigV4.now = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+	return sigV4
+}
+
+func TestSigV4Vectors(t *testing.T) {
+	rt := newTestSigV4RoundTripper(t, "", nil)
+	for _, v := range sigV4Vectors {
+		req, err := http.NewRequest(v.method, v.url, strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.contentType != "" {
+			req.Header.Set("Content-Type", v.contentType)
+		}
+		rt.sign(req, []byte(v.body))
+
+		canonicalRequest, _ := sigV4CanonicalRequest(req, hashHex([]byte(v.body)))
+		if canonicalRequest != v.canonicalRequest {
+			t.Errorf("%s: unexpected canonical request:\n%s\nexpected:\n%s", v.name, canonicalRequest, v.canonicalRequest)
+		}
+		if stringToSign := sigV4StringToSign("20150830T123600Z", "20150830/us-east-1/service/aws4_request", canonicalRequest); stringToSign != v.stringToSign {
+			t.Errorf("%s: unexpected string to sign:\n%s\nexpected:\n%s", v.name, stringToSign, v.stringToSign)
+		}
+		if authorization := req.Header.Get("Authorization"); authorization != v.authorization {
+			t.Errorf("%s: unexpected authorization:\n%s\nexpected:\n%s", v.name, authorization, v.authorization)
+		}
+	}
+}
+
+func TestSigV4RoundTrip(t *testing.T) {
+	const (
+		body         = `{"metric":"up"}`
+		sessionToken = "session/token=="
+	)
+
+	var (
+		received   *http.Request
+		receivedBs []byte
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBs, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	rt := newTestSigV4RoundTripper(t, sessionToken, http.DefaultTransport)
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/remote_write?b=2&a=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if string(receivedBs) != body {
+		t.Errorf("unexpected body %q sent after signed", receivedBs)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("the request of the caller is modified")
+	}
+	if token := received.Header.Get("X-Amz-Security-Token"); token != sessionToken {
+		t.Errorf("unexpected session token %q", token)
+	}
+
+	// the session token is signed, and the payload hash is the sha256 of the body
+	signed := req.Clone(req.Context())
+	signed.Header.Set("X-Amz-Date", "20150830T123600Z")
+	signed.Header.Set("X-Amz-Security-Token", sessionToken)
+	canonicalRequest, signedHeaders := sigV4CanonicalRequest(signed, hashHex([]byte(body)))
+	if signedHeaders != "content-type;host;x-amz-date;x-amz-security-token" {
+		t.Errorf("unexpected signed headers %s", signedHeaders)
+	}
+	if !strings.HasSuffix(canonicalRequest, "\n"+hashHex([]byte(body))) || !strings.Contains(canonicalRequest, "\n/api/v1/remote_write\na=1&b=2\n") {
+		t.Errorf("unexpected canonical request:\n%s", canonicalRequest)
+	}
+	stringToSign := sigV4StringToSign("20150830T123600Z", "20150830/us-east-1/service/aws4_request", canonicalRequest)
+	signature := hex.EncodeToString(hmacSHA256(rt.signingKey("20150830"), stringToSign))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=" +
+		signedHeaders + ", Signature=" + signature
+	if authorization := received.Header.Get("Authorization"); authorization != expected {
+		t.Errorf("unexpected authorization:\n%s\nexpected:\n%s", authorization, expected)
+	}
+}
+
+func TestSigV4Config(t *testing.T) {
+	for _, cfg := range []*SigV4Config{
+		{Region: "us-east-1", AccessKey: "a"},
+		{Region: "us-east-1", SecretKey: "s"},
+	} {
+		if _, err := newSigV4RoundTripper(cfg, nil); err == nil {
+			t.Errorf("expected the error of %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingIdentity     = "identity"
+	EncodingGzip         = "gzip"
+	EncodingDeflate      = "deflate"
+	EncodingZstd         = "zstd"
+	EncodingSnappy       = "snappy"
+	EncodingSnappyFramed = "x-snappy-framed"
+)
+
+// Compressor compresses a whole body. Implementations must be safe for
+// concurrent use.
+type Compressor interface {
+	// Compress returns the compressed data
+	Compress(data []byte) ([]byte, error)
+	// ContentEncoding returns the value of the Content-Encoding header
+	ContentEncoding() string
+}
+
+// CompressorFactory returns a Compressor with the level, 0 is the default level
+type CompressorFactory func(level int) (Compressor, error)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]CompressorFactory{
+		EncodingIdentity:     func(int) (Compressor, error) { return identityCompressor{}, nil },
+		EncodingGzip:         newGzipCompressor,
+		EncodingDeflate:      newDeflateCompressor,
+		EncodingZstd:         newZstdCompressor,
+		EncodingSnappy:       func(int) (Compressor, error) { return snappyCompressor{}, nil },
+		EncodingSnappyFramed: func(int) (Compressor, error) { return snappyFramedCompressor{}, nil },
+	}
+)
+
+// RegisterCompressor adds or replaces the compressor of the encoding
+func RegisterCompressor(encoding string, fn CompressorFactory) {
+	if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding == "" {
+		panic("empty compressor encoding")
+	}
+	if fn == nil {
+		panic("nil compressor factory")
+	}
+
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[encoding] = fn
+}
+
+// NewCompressor returns the compressor of the encoding, the empty encoding is identity.
+func NewCompressor(encoding string, level int) (Compressor, error) {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" {
+		encoding = EncodingIdentity
+	}
+
+	compressorsMu.RLock()
+	fn, ok := compressors[encoding]
+	compressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+	return fn(level)
+}
+
+type identityCompressor struct{}
+
+func (identityCompressor) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (identityCompressor) ContentEncoding() string {
+	return ""
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+// newGzipCompressor accepts the levels of compress/gzip, from -2 (huffman only) to 9
+func newGzipCompressor(level int) (Compressor, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip level: %d", level)
+	}
+	return &gzipCompressor{level: level}, nil
+}
+
+func (p *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, p.level)
+	if err != nil {
+		return nil, err
+	}
+	return closeWriter(buf, w, data)
+}
+
+func (p *gzipCompressor) ContentEncoding() string {
+	return EncodingGzip
+}
+
+// deflateCompressor writes the zlib format which the deflate content encoding is
+type deflateCompressor struct {
+	level int
+}
+
+func newDeflateCompressor(level int) (Compressor, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid deflate level: %d", level)
+	}
+	return &deflateCompressor{level: level}, nil
+}
+
+func (p *deflateCompressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := zlib.NewWriterLevel(buf, p.level)
+	if err != nil {
+		return nil, err
+	}
+	return closeWriter(buf, w, data)
+}
+
+func (p *deflateCompressor) ContentEncoding() string {
+	return EncodingDeflate
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+}
+
+// newZstdCompressor accepts the levels of zstd from 1 to 22, which are mapped to
+// the nearest level the encoder implements
+func newZstdCompressor(level int) (Compressor, error) {
+	var opts []zstd.EOption
+	if level != 0 {
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("invalid zstd level: %d", level)
+		}
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{encoder: encoder}, nil
+}
+
+func (p *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return p.encoder.EncodeAll(data, nil), nil
+}
+
+func (p *zstdCompressor) ContentEncoding() string {
+	return EncodingZstd
+}
+
+// snappyCompressor writes the snappy block format, as the prometheus remote write
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return s2.EncodeSnappy(nil, data), nil
+}
+
+func (snappyCompressor) ContentEncoding() string {
+	return EncodingSnappy
+}
+
+// snappyFramedCompressor writes the snappy framing format
+type snappyFramedCompressor struct{}
+
+func (snappyFramedCompressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	return closeWriter(buf, s2.NewWriter(buf, s2.WriterSnappyCompat(), s2.WriterConcurrency(1)), data)
+}
+
+func (snappyFramedCompressor) ContentEncoding() string {
+	return EncodingSnappyFramed
+}
+
+func closeWriter(buf *bytes.Buffer, w io.WriteCloser, data []byte) ([]byte, error) {
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
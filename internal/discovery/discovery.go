@@ -0,0 +1,239 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// AddressLabel is the label of the address of a target discovered
+	AddressLabel = "__address__"
+	// SchemeLabel overrides the scheme of the url of a target
+	SchemeLabel = "__scheme__"
+	// MetricsPathLabel overrides the path of the url of a target
+	MetricsPathLabel = "__metrics_path__"
+	// MetaLabelPrefix is the prefix of the labels set by the discoverers
+	MetaLabelPrefix = "__meta_"
+	// ReservedLabelPrefix is the prefix of the labels dropped after relabeling
+	ReservedLabelPrefix = "__"
+)
+
+// Group is a group of the targets sharing the labels, the format of the file_sd and the http_sd:
+//
+//	[{"targets": ["10.0.0.1:9404"], "labels": {"service": "kafka"}}]
+type Group struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+// Discoverer discovers the groups of the targets
+type Discoverer interface {
+	// Refresh returns all the groups discovered now
+	Refresh(ctx context.Context) ([]*Group, error)
+}
+
+// watcher is a discoverer notified of the changes, it is refreshed at the changes besides the interval
+type watcher interface {
+	// Watch returns a channel receiving the changes until the ctx is done
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+// Config is the discovery configs of an input, the same as the ones of prometheus
+type Config struct {
+	FileSDConfigs []*FileSDConfig `yaml:"file_sd_configs" json:"file_sd_configs"`
+	DNSSDConfigs  []*DNSSDConfig  `yaml:"dns_sd_configs" json:"dns_sd_configs"`
+	HTTPSDConfigs []*HTTPSDConfig `yaml:"http_sd_configs" json:"http_sd_configs"`
+}
+
+// Empty returns true if no discovery is configured
+func (p *Config) Empty() bool {
+	return len(p.FileSDConfigs) == 0 && len(p.DNSSDConfigs) == 0 && len(p.HTTPSDConfigs) == 0
+}
+
+// provider refreshes a discoverer at the interval, the groups of the last refresh succeeded are kept
+type provider struct {
+	name       string
+	discoverer Discoverer
+	interval   time.Duration
+	groups     []*Group
+	// changes are the changes of a watcher, nil if the discoverer is not watched
+	changes <-chan struct{}
+}
+
+// Manager refreshes the discoverers of a config in the background
+type Manager struct {
+	logger    log.Logger
+	providers []*provider
+
+	mu       sync.RWMutex
+	stopChan chan struct{}
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// NewManager returns a manager of the discoverers of the config
+func NewManager(cfg Config, logger log.Logger) (*Manager, error) {
+	p := &Manager{logger: logger}
+
+	for i, c := range cfg.FileSDConfigs {
+		d, err := newFileDiscoverer(c, logger)
+		if err != nil {
+			return nil, fmt.Errorf("file_sd_configs[%d]: %w", i, err)
+		}
+		p.add(fmt.Sprintf("file_sd/%d", i), d, c.interval())
+	}
+	for i, c := range cfg.DNSSDConfigs {
+		ds, err := newDNSDiscoverers(c)
+		if err != nil {
+			return nil, fmt.Errorf("dns_sd_configs[%d]: %w", i, err)
+		}
+		// every name is refreshed by itself, a name failed doesn't remove the targets of the others
+		for j, d := range ds {
+			p.add(fmt.Sprintf("dns_sd/%d/%s", i, c.Names[j]), d, c.interval())
+		}
+	}
+	for i, c := range cfg.HTTPSDConfigs {
+		d, err := newHTTPDiscoverer(c)
+		if err != nil {
+			return nil, fmt.Errorf("http_sd_configs[%d]: %w", i, err)
+		}
+		p.add(fmt.Sprintf("http_sd/%d", i), d, c.interval())
+	}
+	return p, nil
+}
+
+func (p *Manager) add(name string, d Discoverer, interval time.Duration) {
+	p.providers = append(p.providers, &provider{name: name, discoverer: d, interval: interval})
+}
+
+// Start refreshes all the discoverers once, then refreshes them at their intervals and the changes
+// of the watchers until stopped
+func (p *Manager) Start() {
+	p.stopChan = make(chan struct{})
+
+	// the watchers are started before the first refresh, so the changes in between are not missed
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	for _, pr := range p.providers {
+		p.watch(ctx, pr)
+	}
+
+	var wg sync.WaitGroup
+	for _, pr := range p.providers {
+		wg.Add(1)
+		go func(pr *provider) {
+			defer wg.Done()
+			p.refresh(pr)
+		}(pr)
+	}
+	wg.Wait()
+
+	for _, pr := range p.providers {
+		p.wg.Add(1)
+		go p.run(pr)
+	}
+}
+
+// Stop stops the refreshes
+func (p *Manager) Stop() {
+	if p.stopChan == nil {
+		return
+	}
+	close(p.stopChan)
+	p.cancel()
+	p.wg.Wait()
+	p.stopChan = nil
+}
+
+// watch starts the watcher of the discoverer, the interval is the fallback of a discoverer failed to watch
+func (p *Manager) watch(ctx context.Context, pr *provider) {
+	w, ok := pr.discoverer.(watcher)
+	if !ok {
+		return
+	}
+	changes, err := w.Watch(ctx)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "watch_discovery_failed", "provider", pr.name, "error", err)
+		return
+	}
+	pr.changes = changes
+}
+
+func (p *Manager) run(pr *provider) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+
+	changes := pr.changes
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.refresh(pr)
+		case _, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			p.refresh(pr)
+		}
+	}
+}
+
+func (p *Manager) refresh(pr *provider) {
+	ctx, cancel := context.WithTimeout(context.Background(), pr.interval)
+	defer cancel()
+
+	groups, err := pr.discoverer.Refresh(ctx)
+	if err != nil {
+		level.Error(p.logger).Log("msg", "refresh_discovery_failed", "provider", pr.name, "error", err)
+		return
+	}
+
+	p.mu.Lock()
+	pr.groups = groups
+	p.mu.Unlock()
+	level.Debug(p.logger).Log("msg", "refresh_discovery", "provider", pr.name, "groups", len(groups))
+}
+
+// Targets returns the labels of all the targets discovered, the label __address__ is the target,
+// and the labels of its group are included
+func (p *Manager) Targets() []map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var targets []map[string]string
+	for _, pr := range p.providers {
+		for _, group := range pr.groups {
+			for _, target := range group.Targets {
+				labels := make(map[string]string, len(group.Labels)+1)
+				for k, v := range group.Labels {
+					labels[k] = v
+				}
+				labels[AddressLabel] = target
+				targets = append(targets, labels)
+			}
+		}
+	}
+	return targets
+}
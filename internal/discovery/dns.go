@@ -0,0 +1,125 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	defaultDNSRefreshInterval = 30 * time.Second
+
+	dnsMetaLabelName      = MetaLabelPrefix + "dns_name"
+	dnsMetaLabelSRVTarget = MetaLabelPrefix + "dns_srv_record_target"
+	dnsMetaLabelSRVPort   = MetaLabelPrefix + "dns_srv_record_port"
+
+	dnsTypeSRV  = "SRV"
+	dnsTypeA    = "A"
+	dnsTypeAAAA = "AAAA"
+)
+
+// DNSSDConfig discovers the targets by the SRV, A or AAAA records of the names
+type DNSSDConfig struct {
+	Names []string `yaml:"names" json:"names"`
+	// Type is SRV, A or AAAA, defaults SRV
+	Type string `yaml:"type" json:"type"`
+	// Port of the targets of the A and AAAA records, the ports of the SRV records are used by themselves
+	Port            int            `yaml:"port" json:"port"`
+	RefreshInterval types.Duration `yaml:"refresh_interval" json:"refresh_interval"`
+}
+
+func (p *DNSSDConfig) interval() time.Duration {
+	if p.RefreshInterval > 0 {
+		return time.Duration(p.RefreshInterval)
+	}
+	return defaultDNSRefreshInterval
+}
+
+type dnsDiscoverer struct {
+	name     string
+	qtype    string
+	port     int
+	resolver *net.Resolver
+}
+
+// newDNSDiscoverers returns a discoverer for each name of the config
+func newDNSDiscoverers(cfg *DNSSDConfig) ([]*dnsDiscoverer, error) {
+	if len(cfg.Names) == 0 {
+		return nil, fmt.Errorf("names are required")
+	}
+	qtype := strings.ToUpper(cfg.Type)
+	switch qtype {
+	case "":
+		qtype = dnsTypeSRV
+	case dnsTypeSRV:
+	case dnsTypeA, dnsTypeAAAA:
+		if cfg.Port <= 0 {
+			return nil, fmt.Errorf("port is required for the %s records", qtype)
+		}
+	default:
+		return nil, fmt.Errorf("invalid type %q, should be SRV, A or AAAA", cfg.Type)
+	}
+
+	var ds []*dnsDiscoverer
+	for _, name := range cfg.Names {
+		ds = append(ds, &dnsDiscoverer{name: name, qtype: qtype, port: cfg.Port, resolver: net.DefaultResolver})
+	}
+	return ds, nil
+}
+
+func (p *dnsDiscoverer) Refresh(ctx context.Context) ([]*Group, error) {
+	group := &Group{Labels: map[string]string{dnsMetaLabelName: p.name}}
+
+	if p.qtype == dnsTypeSRV {
+		_, srvs, err := p.resolver.LookupSRV(ctx, "", "", p.name)
+		if err != nil {
+			return nil, err
+		}
+		var groups []*Group
+		for _, srv := range srvs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			port := strconv.Itoa(int(srv.Port))
+			groups = append(groups, &Group{
+				Targets: []string{net.JoinHostPort(target, port)},
+				Labels: map[string]string{
+					dnsMetaLabelName:      p.name,
+					dnsMetaLabelSRVTarget: target,
+					dnsMetaLabelSRVPort:   port,
+				},
+			})
+		}
+		return groups, nil
+	}
+
+	network := "ip4"
+	if p.qtype == dnsTypeAAAA {
+		network = "ip6"
+	}
+	ips, err := p.resolver.LookupIP(ctx, network, p.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		group.Targets = append(group.Targets, net.JoinHostPort(ip.String(), strconv.Itoa(p.port)))
+	}
+	return []*Group{group}, nil
+}
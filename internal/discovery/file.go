@@ -0,0 +1,187 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"gopkg.in/yaml.v2"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	defaultFileRefreshInterval = 30 * time.Second
+
+	fileMetaLabelPath = MetaLabelPrefix + "filepath"
+)
+
+// FileSDConfig discovers the groups in the json or yaml files, the directories of the files
+// are watched, so the changes are picked up without restarting, and the files are read again
+// at every refresh_interval in case an event is missed
+type FileSDConfig struct {
+	// Files are the paths or the glob patterns, such as "targets/*.json"
+	Files           []string       `yaml:"files" json:"files"`
+	RefreshInterval types.Duration `yaml:"refresh_interval" json:"refresh_interval"`
+}
+
+func (p *FileSDConfig) interval() time.Duration {
+	if p.RefreshInterval > 0 {
+		return time.Duration(p.RefreshInterval)
+	}
+	return defaultFileRefreshInterval
+}
+
+type fileDiscoverer struct {
+	logger log.Logger
+	files  []string
+}
+
+func newFileDiscoverer(cfg *FileSDConfig, logger log.Logger) (*fileDiscoverer, error) {
+	if len(cfg.Files) == 0 {
+		return nil, fmt.Errorf("files are required")
+	}
+	for _, pattern := range cfg.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		switch ext := filepath.Ext(pattern); ext {
+		case ".json", ".yml", ".yaml":
+		default:
+			return nil, fmt.Errorf("file %q must be a json or yaml file", pattern)
+		}
+	}
+	return &fileDiscoverer{logger: logger, files: cfg.Files}, nil
+}
+
+// Watch watches the directories of the files, a change of a file matched is sent to the
+// channel, the changes not received yet are merged into one
+func (p *fileDiscoverer) Watch(ctx context.Context) (<-chan struct{}, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]bool)
+	for _, pattern := range p.files {
+		dir := filepath.Dir(pattern)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		// a directory of a pattern such as "*/targets.json" is not watched, it is refreshed at the interval
+		if strings.ContainsAny(dir, "*?[") {
+			level.Warn(p.logger).Log("msg", "skip_watch_pattern", "dir", dir)
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("watch %s failed: %w", dir, err)
+		}
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer w.Close()
+		defer close(changes)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !p.match(event.Name) {
+					continue
+				}
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				level.Error(p.logger).Log("msg", "watch_files_failed", "error", err)
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// match returns true if the name matches a pattern of the files
+func (p *fileDiscoverer) match(name string) bool {
+	for _, pattern := range p.files {
+		if ok, _ := filepath.Match(filepath.Clean(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh reads all the files matched, a file failed fails the refresh, so the targets
+// in a file being written are not removed
+func (p *fileDiscoverer) Refresh(context.Context) ([]*Group, error) {
+	var groups []*Group
+	for _, pattern := range p.files {
+		filenames, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			fileGroups, err := readGroupsFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, fileGroups...)
+		}
+	}
+	return groups, nil
+}
+
+func readGroupsFile(filename string) ([]*Group, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*Group
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(bs, &groups)
+	default:
+		err = yaml.Unmarshal(bs, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s failed: %w", filename, err)
+	}
+
+	for _, group := range groups {
+		if group.Labels == nil {
+			group.Labels = make(map[string]string)
+		}
+		group.Labels[fileMetaLabelPath] = filename
+	}
+	return groups, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+func writeFile(t *testing.T, filename, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addresses returns the sorted __address__ of the targets
+func addresses(targets []map[string]string) []string {
+	var addrs []string
+	for _, labels := range targets {
+		addrs = append(addrs, labels[AddressLabel])
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFileDiscoverer(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile, yamlFile := filepath.Join(dir, "a.json"), filepath.Join(dir, "b.yml")
+	writeFile(t, jsonFile, `[{"targets": ["10.0.0.1:9404", "10.0.0.2:9404"], "labels": {"service": "kafka"}}]`)
+	writeFile(t, yamlFile, "- targets: [\"10.0.0.3:9100\"]\n")
+
+	d, err := newFileDiscoverer(&FileSDConfig{Files: []string{filepath.Join(dir, "*.json"), yamlFile}}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := d.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("unexpected groups: %d, expected 2", len(groups))
+	}
+	if labels := groups[0].Labels; labels["service"] != "kafka" || labels[fileMetaLabelPath] != jsonFile {
+		t.Errorf("unexpected labels of %s: %v", jsonFile, labels)
+	}
+	if labels := groups[1].Labels; labels[fileMetaLabelPath] != yamlFile || len(groups[1].Targets) != 1 {
+		t.Errorf("unexpected group of %s: %v", yamlFile, groups[1])
+	}
+
+	writeFile(t, filepath.Join(dir, "c.json"), `[{"targets": `)
+	if _, err := d.Refresh(context.Background()); err == nil {
+		t.Errorf("expected the error of the invalid file")
+	}
+}
+
+func TestFileDiscovererInvalidConfig(t *testing.T) {
+	for _, files := range [][]string{
+		nil,
+		{"targets/*.txt"},
+		{"targets/[.json"},
+	} {
+		if _, err := newFileDiscoverer(&FileSDConfig{Files: files}, log.NewNopLogger()); err == nil {
+			t.Errorf("expected the error of the files %v", files)
+		}
+	}
+}
+
+func TestManagerKeepsGroupsOfFailedRefresh(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "targets.json")
+	writeFile(t, filename, `[{"targets": ["10.0.0.1:9404"]}]`)
+
+	m, err := NewManager(Config{FileSDConfigs: []*FileSDConfig{{Files: []string{filepath.Join(dir, "*.json")}}}}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := m.providers[0]
+	m.refresh(pr)
+	if addrs := addresses(m.Targets()); !equalStrings(addrs, []string{"10.0.0.1:9404"}) {
+		t.Fatalf("unexpected targets: %v", addrs)
+	}
+
+	// a file being written keeps the targets of the last refresh
+	writeFile(t, filename, `[{"targets": ["10.0.0.1:9404",`)
+	m.refresh(pr)
+	if addrs := addresses(m.Targets()); !equalStrings(addrs, []string{"10.0.0.1:9404"}) {
+		t.Errorf("unexpected targets of the invalid file: %v", addrs)
+	}
+
+	writeFile(t, filename, `[{"targets": ["10.0.0.1:9404", "10.0.0.2:9404"]}]`)
+	m.refresh(pr)
+	if addrs := addresses(m.Targets()); !equalStrings(addrs, []string{"10.0.0.1:9404", "10.0.0.2:9404"}) {
+		t.Errorf("unexpected targets of the file fixed: %v", addrs)
+	}
+}
+
+func TestManagerWatchesFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), `[{"targets": ["10.0.0.1:9404"]}]`)
+
+	// the interval is longer than the test, the changes are picked up by the watcher
+	m, err := NewManager(Config{FileSDConfigs: []*FileSDConfig{{
+		Files:           []string{filepath.Join(dir, "*.json")},
+		RefreshInterval: types.Duration(time.Hour),
+	}}}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+
+	if addrs := addresses(m.Targets()); !equalStrings(addrs, []string{"10.0.0.1:9404"}) {
+		t.Fatalf("unexpected targets: %v", addrs)
+	}
+
+	writeFile(t, filepath.Join(dir, "b.json"), `[{"targets": ["10.0.0.2:9404"]}]`)
+	writeFile(t, filepath.Join(dir, "ignored.txt"), `[{"targets": ["10.0.0.3:9404"]}]`)
+
+	expected := []string{"10.0.0.1:9404", "10.0.0.2:9404"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		addrs := addresses(m.Targets())
+		if equalStrings(addrs, expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected targets after the change: %v, expected %v", addrs, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
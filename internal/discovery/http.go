@@ -0,0 +1,126 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/internal"
+	"trellis.tech/kolekti/prome_exporters/internal/auth"
+
+	"trellis.tech/trellis/common.v1/crypto/tls"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	defaultHTTPRefreshInterval = time.Minute
+
+	httpMetaLabelURL = MetaLabelPrefix + "url"
+)
+
+// HTTPSDConfig discovers the groups by GET the url, which responds the groups in json
+type HTTPSDConfig struct {
+	URL             string         `yaml:"url" json:"url"`
+	RefreshInterval types.Duration `yaml:"refresh_interval" json:"refresh_interval"`
+
+	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
+
+	Auth auth.Config `yaml:",inline" json:",inline"`
+}
+
+func (p *HTTPSDConfig) interval() time.Duration {
+	if p.RefreshInterval > 0 {
+		return time.Duration(p.RefreshInterval)
+	}
+	return defaultHTTPRefreshInterval
+}
+
+type httpDiscoverer struct {
+	url    string
+	name   string
+	client *http.Client
+}
+
+func newHTTPDiscoverer(cfg *HTTPSDConfig) (*httpDiscoverer, error) {
+	urlP, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if urlP.Scheme != "http" && urlP.Scheme != "https" {
+		return nil, fmt.Errorf("url %q must be http or https", urlP.Redacted())
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if cfg.TlsConfig != nil {
+		tlsConfig, err := cfg.TlsConfig.GetTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	roundTripper, err := cfg.Auth.NewRoundTripper(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpDiscoverer{
+		url:    cfg.URL,
+		name:   urlP.Redacted(),
+		client: &http.Client{Transport: roundTripper},
+	}, nil
+}
+
+func (p *httpDiscoverer) Refresh(ctx context.Context) ([]*Group, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.IOClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("when reading [%s] received status code: %d", p.name, resp.StatusCode)
+	}
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*Group
+	if err := json.Unmarshal(bs, &groups); err != nil {
+		return nil, fmt.Errorf("parse the groups of [%s] failed: %w", p.name, err)
+	}
+
+	for _, group := range groups {
+		if group.Labels == nil {
+			group.Labels = make(map[string]string)
+		}
+		group.Labels[httpMetaLabelURL] = p.name
+	}
+	return groups, nil
+}
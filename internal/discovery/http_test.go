@@ -0,0 +1,74 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPDiscoverer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/targets":
+			if r.Header.Get("Accept") != "application/json" {
+				t.Errorf("unexpected accept: %q", r.Header.Get("Accept"))
+			}
+			fmt.Fprint(w, `[{"targets": ["10.0.0.1:9404"], "labels": {"service": "kafka"}}, {"targets": ["10.0.0.2:9100"]}]`)
+		case "/invalid":
+			fmt.Fprint(w, `{"targets": ["10.0.0.1:9404"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	d, err := newHTTPDiscoverer(&HTTPSDConfig{URL: ts.URL + "/targets"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := d.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("unexpected groups: %d, expected 2", len(groups))
+	}
+	if labels := groups[0].Labels; labels["service"] != "kafka" || labels[httpMetaLabelURL] != ts.URL+"/targets" {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+	if labels := groups[1].Labels; labels[httpMetaLabelURL] != ts.URL+"/targets" {
+		t.Errorf("unexpected labels of the group without labels: %v", labels)
+	}
+
+	for _, path := range []string{"/invalid", "/notfound"} {
+		d, err := newHTTPDiscoverer(&HTTPSDConfig{URL: ts.URL + path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Refresh(context.Background()); err == nil {
+			t.Errorf("expected the error of %s", path)
+		}
+	}
+}
+
+func TestHTTPDiscovererInvalidURL(t *testing.T) {
+	if _, err := newHTTPDiscoverer(&HTTPSDConfig{URL: "ftp://127.0.0.1/targets"}); err == nil {
+		t.Errorf("expected the error of the scheme ftp")
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+
+	defaultRelabelSeparator   = ";"
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// RelabelConfig rewrites the labels of a target discovered, the same as the relabel_configs of prometheus:
+//
+//	source_labels: [__meta_dns_name]
+//	regex: "(.+)\\.service\\.consul"
+//	target_label: service
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels" json:"source_labels"`
+	// Separator joins the values of the source labels, defaults ";"
+	Separator string `yaml:"separator" json:"separator"`
+	// Regex is anchored at both ends, defaults "(.*)"
+	Regex       string `yaml:"regex" json:"regex"`
+	TargetLabel string `yaml:"target_label" json:"target_label"`
+	// Replacement is expanded with the groups captured, defaults "$1"
+	Replacement string `yaml:"replacement" json:"replacement"`
+	// Action is replace, keep, drop, labelmap, labeldrop or labelkeep, defaults replace
+	Action string `yaml:"action" json:"action"`
+
+	re *regexp.Regexp
+}
+
+// Compile checks the config and compiles the regex, it must be called before Relabel
+func (p *RelabelConfig) Compile() (err error) {
+	if p.Separator == "" {
+		p.Separator = defaultRelabelSeparator
+	}
+	if p.Regex == "" {
+		p.Regex = defaultRelabelRegex
+	}
+	if p.Replacement == "" {
+		p.Replacement = defaultRelabelReplacement
+	}
+	if p.Action == "" {
+		p.Action = RelabelReplace
+	}
+	p.Action = strings.ToLower(p.Action)
+
+	switch p.Action {
+	case RelabelReplace:
+		if p.TargetLabel == "" {
+			return fmt.Errorf("target_label is required for the action replace")
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(p.SourceLabels) == 0 {
+			return fmt.Errorf("source_labels are required for the action %s", p.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("invalid relabel action %q", p.Action)
+	}
+
+	if p.re, err = regexp.Compile("^(?:" + p.Regex + ")$"); err != nil {
+		return fmt.Errorf("invalid relabel regex %q: %w", p.Regex, err)
+	}
+	return nil
+}
+
+// Relabel applies the configs in order to a copy of the labels, nil is returned if the target is dropped
+func Relabel(labels map[string]string, cfgs []*RelabelConfig) map[string]string {
+	lbls := make(map[string]string, len(labels))
+	for k, v := range labels {
+		lbls[k] = v
+	}
+
+	for _, cfg := range cfgs {
+		values := make([]string, 0, len(cfg.SourceLabels))
+		for _, name := range cfg.SourceLabels {
+			values = append(values, lbls[name])
+		}
+		value := strings.Join(values, cfg.Separator)
+
+		switch cfg.Action {
+		case RelabelKeep:
+			if !cfg.re.MatchString(value) {
+				return nil
+			}
+		case RelabelDrop:
+			if cfg.re.MatchString(value) {
+				return nil
+			}
+		case RelabelReplace:
+			indexes := cfg.re.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			target := string(cfg.re.ExpandString(nil, cfg.TargetLabel, value, indexes))
+			if !labelNameRE.MatchString(target) {
+				continue
+			}
+			res := string(cfg.re.ExpandString(nil, cfg.Replacement, value, indexes))
+			if res == "" {
+				delete(lbls, target)
+				continue
+			}
+			lbls[target] = res
+		case RelabelLabelMap:
+			// the names are sorted, so the result is the same when the labels mapped conflict
+			for _, name := range sortedNames(lbls) {
+				if cfg.re.MatchString(name) {
+					lbls[cfg.re.ReplaceAllString(name, cfg.Replacement)] = lbls[name]
+				}
+			}
+		case RelabelLabelDrop:
+			for name := range lbls {
+				if cfg.re.MatchString(name) {
+					delete(lbls, name)
+				}
+			}
+		case RelabelLabelKeep:
+			for name := range lbls {
+				if !cfg.re.MatchString(name) {
+					delete(lbls, name)
+				}
+			}
+		}
+	}
+	return lbls
+}
+
+func sortedNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,152 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRelabel(t *testing.T) {
+	labels := map[string]string{
+		AddressLabel:               "10.0.0.1:9404",
+		"__meta_dns_name":          "kafka.service.consul",
+		"__meta_consul_tag_region": "eu",
+		"env":                      "prod",
+	}
+
+	for _, c := range []struct {
+		name     string
+		cfgs     []*RelabelConfig
+		expected map[string]string
+	}{
+		{
+			name: "replace",
+			cfgs: []*RelabelConfig{{
+				SourceLabels: []string{"__meta_dns_name"},
+				Regex:        `(.+)\.service\.consul`,
+				TargetLabel:  "service",
+			}},
+			expected: map[string]string{"service": "kafka"},
+		},
+		{
+			name: "replace not matched",
+			cfgs: []*RelabelConfig{{
+				SourceLabels: []string{"env"},
+				Regex:        "dev",
+				TargetLabel:  "service",
+				Replacement:  "x",
+			}},
+			expected: map[string]string{},
+		},
+		{
+			name: "replace with the separator",
+			cfgs: []*RelabelConfig{{
+				SourceLabels: []string{"env", "__meta_consul_tag_region"},
+				Separator:    "-",
+				TargetLabel:  "zone",
+			}},
+			expected: map[string]string{"zone": "prod-eu"},
+		},
+		{
+			name: "replace the address",
+			cfgs: []*RelabelConfig{{
+				SourceLabels: []string{AddressLabel},
+				Regex:        `([^:]+):\d+`,
+				TargetLabel:  AddressLabel,
+				Replacement:  "$1:8080",
+			}},
+			expected: map[string]string{AddressLabel: "10.0.0.1:8080"},
+		},
+		{
+			name:     "labelmap",
+			cfgs:     []*RelabelConfig{{Action: RelabelLabelMap, Regex: "__meta_consul_tag_(.+)"}},
+			expected: map[string]string{"region": "eu"},
+		},
+		{
+			name:     "labeldrop",
+			cfgs:     []*RelabelConfig{{Action: RelabelLabelDrop, Regex: "env"}},
+			expected: map[string]string{"env": ""},
+		},
+	} {
+		for _, cfg := range c.cfgs {
+			if err := cfg.Compile(); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		expected := make(map[string]string)
+		for k, v := range labels {
+			expected[k] = v
+		}
+		for k, v := range c.expected {
+			if v == "" {
+				delete(expected, k)
+				continue
+			}
+			expected[k] = v
+		}
+
+		if res := Relabel(labels, c.cfgs); !reflect.DeepEqual(res, expected) {
+			t.Errorf("%s: unexpected labels %v, expected %v", c.name, res, expected)
+		}
+	}
+	if labels["service"] != "" || labels[AddressLabel] != "10.0.0.1:9404" {
+		t.Errorf("the labels relabeled are changed: %v", labels)
+	}
+}
+
+func TestRelabelKeepDrop(t *testing.T) {
+	keep := &RelabelConfig{Action: RelabelKeep, SourceLabels: []string{"env"}, Regex: "prod|staging"}
+	drop := &RelabelConfig{Action: RelabelDrop, SourceLabels: []string{"env"}, Regex: "staging"}
+	labelKeep := &RelabelConfig{Action: "LabelKeep", Regex: "__.+"}
+	for _, cfg := range []*RelabelConfig{keep, drop, labelKeep} {
+		if err := cfg.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		env     string
+		dropped bool
+	}{
+		{env: "prod"},
+		{env: "staging", dropped: true},
+		{env: "dev", dropped: true},
+		// the regex is anchored at both ends
+		{env: "production", dropped: true},
+	} {
+		res := Relabel(map[string]string{AddressLabel: "10.0.0.1:9404", "env": c.env}, []*RelabelConfig{keep, drop, labelKeep})
+		if c.dropped != (res == nil) {
+			t.Errorf("env %s: unexpected labels %v, dropped %v", c.env, res, c.dropped)
+			continue
+		}
+		if !c.dropped && !reflect.DeepEqual(res, map[string]string{AddressLabel: "10.0.0.1:9404"}) {
+			t.Errorf("env %s: unexpected labels %v of labelkeep", c.env, res)
+		}
+	}
+}
+
+func TestRelabelConfigCompile(t *testing.T) {
+	for _, cfg := range []*RelabelConfig{
+		{Action: "unknown"},
+		{Action: RelabelReplace},
+		{Action: RelabelKeep},
+		{Action: RelabelLabelMap, Regex: "("},
+	} {
+		if err := cfg.Compile(); err == nil {
+			t.Errorf("expected the error of %+v", cfg)
+		}
+	}
+}
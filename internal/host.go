@@ -0,0 +1,94 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// sources of the host identity
+const (
+	HostSourceHostname  = "hostname"
+	HostSourceFQDN      = "fqdn"
+	HostSourceInterface = "interface"
+	HostSourceIPv4      = "ipv4"
+	HostSourceIPv6      = "ipv6"
+	HostSourceStatic    = "static"
+
+	DefaultHostSource = HostSourceIPv4
+)
+
+// ResolveHost returns the host identity of the source:
+//
+//	hostname: os.Hostname
+//	fqdn: the name which the addresses of the hostname are resolved to, the hostname if not resolved
+//	interface: the first address of the interface, ipv4 unless ipv6 is true
+//	ipv4, ipv6: the first non-loopback address of the interfaces which are up
+//	static: the value
+func ResolveHost(source, iface, value string, ipv6 bool) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(source)) {
+	case "", HostSourceIPv4:
+		return FirstIP(false)
+	case HostSourceIPv6:
+		return FirstIP(true)
+	case HostSourceHostname:
+		return os.Hostname()
+	case HostSourceFQDN:
+		return FQDN()
+	case HostSourceInterface:
+		if iface == "" {
+			return "", fmt.Errorf("interface is required by the host source %s", source)
+		}
+		return InterfaceIP(iface, ipv6)
+	case HostSourceStatic:
+		if value == "" {
+			return "", fmt.Errorf("value is required by the host source %s", source)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported host source: %s", source)
+	}
+}
+
+// FQDN returns the fully qualified domain name of the host, the hostname is returned
+// if it can not be resolved
+func FQDN() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := net.LookupIP(hostname)
+	if err != nil {
+		return hostname, nil
+	}
+	for _, addr := range addrs {
+		if addr.IsLoopback() {
+			continue
+		}
+		names, err := net.LookupAddr(addr.String())
+		if err != nil || len(names) == 0 {
+			continue
+		}
+		return strings.TrimSuffix(names[0], "."), nil
+	}
+	if cname, err := net.LookupCNAME(hostname); err == nil && cname != "" {
+		return strings.TrimSuffix(cname, "."), nil
+	}
+	return hostname, nil
+}
@@ -15,43 +15,10 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package internal
 
 import (
-	"compress/gzip"
 	"io"
-	"sync"
 )
 
 func IOClose(closer io.ReadCloser) {
 	_, _ = io.Copy(io.Discard, closer)
 	_ = closer.Close()
 }
-
-type ReadWaitCloser struct {
-	pipeReader *io.PipeReader
-	wg         sync.WaitGroup
-}
-
-// CompressWithGzip takes an io.Reader as input and pipes
-// it through a gzip.Writer returning an io.Reader containing
-// the gzipped data.
-// An error is returned if passing data to the gzip.Writer fails
-func CompressWithGzip(data io.Reader) (io.ReadCloser, error) {
-	pipeReader, pipeWriter := io.Pipe()
-	gzipWriter := gzip.NewWriter(pipeWriter)
-
-	rc := &ReadWaitCloser{
-		pipeReader: pipeReader,
-	}
-
-	rc.wg.Add(1)
-	var err error
-	go func() {
-		_, err = io.Copy(gzipWriter, data)
-		gzipWriter.Close()
-		// subsequent reads from the read half of the pipe will
-		// return no bytes and the error err, or EOF if err is nil.
-		pipeWriter.CloseWithError(err)
-		rc.wg.Done()
-	}()
-
-	return pipeReader, err
-}
@@ -15,28 +15,64 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"net"
-
-	"trellis.tech/trellis/common.v1/shell"
 )
 
-// GetIP todo ipv6
+// GetIP returns the first non-loopback IPv4 address of the interfaces which are up
 func GetIP() string {
-	ip := shell.Output("hostname -i")
-	if ip != "" {
-		return ip
+	ip, _ := FirstIP(false)
+	return ip
+}
+
+// FirstIP returns the first address of the interfaces which are up and not loopback,
+// in the order of the interface index, link-local addresses are skipped
+func FirstIP(ipv6 bool) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if ip, err := interfaceIP(&iface, ipv6); err == nil {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no non-loopback %s address found", ipFamily(ipv6))
+}
+
+// InterfaceIP returns the first address of the named interface, link-local addresses are skipped
+func InterfaceIP(name string, ipv6 bool) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
 	}
+	return interfaceIP(iface, ipv6)
+}
 
-	addrs, err := net.InterfaceAddrs()
+func interfaceIP(iface *net.Interface, ipv6 bool) (string, error) {
+	addrs, err := iface.Addrs()
 	if err != nil {
-		return ""
+		return "", err
 	}
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
+		ipnet, ok := address.(*net.IPNet)
+		if !ok || ipnet.IP.IsUnspecified() || ipnet.IP.IsLinkLocalUnicast() || ipnet.IP.IsMulticast() {
+			continue
 		}
+		if (ipnet.IP.To4() == nil) == ipv6 {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", errors.New("no " + ipFamily(ipv6) + " address found on interface " + iface.Name)
+}
+
+func ipFamily(ipv6 bool) string {
+	if ipv6 {
+		return "ipv6"
 	}
-	return ""
+	return "ipv4"
 }
@@ -26,6 +26,16 @@ const (
 	InputTypeMetricsCollector
 )
 
+func (t InputType) String() string {
+	switch t {
+	case InputTypePrometheusCollector:
+		return "prometheus_collector"
+	case InputTypeMetricsCollector:
+		return "metrics_collector"
+	}
+	return "unknown"
+}
+
 type Input interface {
 	InputType() InputType
 
@@ -42,3 +52,13 @@ type InputMetricsCollector interface {
 	PluginDescriber
 	Gather() ([]*dto.MetricFamily, error)
 }
+
+// ServiceInput is an InputMetricsCollector which receives the metrics in the background,
+// such as a listener. Start is called once before the first Gather, and Stop is called
+// once when the agent is stopping.
+type ServiceInput interface {
+	InputMetricsCollector
+
+	Start() error
+	Stop()
+}
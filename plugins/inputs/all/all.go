@@ -15,7 +15,11 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package all
 
 import (
+	_ "trellis.tech/kolekti/prome_exporters/plugins/inputs/blackbox"
+	_ "trellis.tech/kolekti/prome_exporters/plugins/inputs/exec"
 	_ "trellis.tech/kolekti/prome_exporters/plugins/inputs/http"
 	_ "trellis.tech/kolekti/prome_exporters/plugins/inputs/promethues_node_exporter"
+	_ "trellis.tech/kolekti/prome_exporters/plugins/inputs/statsd"
+	_ "trellis.tech/kolekti/prome_exporters/plugins/inputs/textfile"
 	_ "trellis.tech/kolekti/prome_exporters/plugins/inputs/zookeeper"
 )
@@ -0,0 +1,331 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package blackbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/inputs"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	beConfig "github.com/prometheus/blackbox_exporter/config"
+	"github.com/prometheus/blackbox_exporter/prober"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultConcurrency = 10
+)
+
+var (
+	// Probers are the probers of blackbox_exporter by the names of the module prober
+	Probers = map[string]prober.ProbeFn{
+		"http": prober.ProbeHTTP,
+		"tcp":  prober.ProbeTCP,
+		"icmp": prober.ProbeICMP,
+		"dns":  prober.ProbeDNS,
+		"grpc": prober.ProbeGRPC,
+	}
+
+	// SharedModules returns the modules of blackbox_probe, the modules or the modules_file reloaded,
+	// which are used by the inputs without modules. It is set by the server before the inputs are
+	// created, and is nil if blackbox_probe has no modules
+	SharedModules func() *beConfig.Config
+
+	labelTarget = "target"
+	labelModule = "module"
+)
+
+// Probe probes each of the targets with each of the modules
+type Probe struct {
+	Targets []string `yaml:"targets" json:"targets"`
+	// Modules are the names of the modules of the input
+	Modules []string `yaml:"modules" json:"modules"`
+
+	Labels map[string]string `yaml:"labels" json:"labels"`
+}
+
+type Collector struct {
+	logger log.Logger
+
+	// Modules are the modules of blackbox_exporter, the same as the modules of blackbox_probe,
+	// the modules of blackbox_probe are used if they are not set
+	Modules map[string]beConfig.Module `yaml:"modules" json:"modules"`
+	Probes  []*Probe                   `yaml:"probes" json:"probes"`
+	// Timeout of a probe if the timeout of the module is not set, defaults 10s
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+	// MaxConcurrency is the number of probes run at the same time, defaults 10
+	MaxConcurrency int `yaml:"max_concurrency" json:"max_concurrency"`
+
+	Tags map[string]string `yaml:"tags" json:"tags"`
+}
+
+// SampleConfig returns the sample config
+func (*Collector) SampleConfig() string {
+	return ``
+}
+
+// Description returns the description
+func (*Collector) Description() string {
+	return `Probes the targets with the modules of blackbox_exporter`
+}
+
+// job is a target probed with a module
+type job struct {
+	target     string
+	moduleName string
+	module     beConfig.Module
+	labels     map[string]string
+}
+
+// modules returns the modules of the input, or the modules of blackbox_probe if they are not set
+func (p *Collector) modules() map[string]beConfig.Module {
+	if len(p.Modules) > 0 || SharedModules == nil {
+		return p.Modules
+	}
+	if c := SharedModules(); c != nil {
+		return c.Modules
+	}
+	return nil
+}
+
+// Gather runs all the probes concurrently, a probe failed is reported by the metric probe_success
+func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
+	// the modules of blackbox_probe may be reloaded, they are got once for all the probes
+	modules := p.modules()
+
+	var jobs []*job
+	for _, probe := range p.Probes {
+		for _, target := range probe.Targets {
+			for _, moduleName := range probe.Modules {
+				module, ok := modules[moduleName]
+				if !ok {
+					level.Warn(p.logger).Log("msg", "unknown_module", "module", moduleName, "target", target)
+					continue
+				}
+				jobs = append(jobs, &job{target: target, moduleName: moduleName, module: module, labels: probe.Labels})
+			}
+		}
+	}
+
+	var (
+		results = make([][]*dto.MetricFamily, len(jobs))
+		sem     = make(chan struct{}, p.MaxConcurrency)
+		wg      sync.WaitGroup
+	)
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, j *job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = p.probe(j)
+		}(i, j)
+	}
+	wg.Wait()
+
+	mfs := make(map[string]*dto.MetricFamily)
+	var names []string
+	for _, families := range results {
+		for _, family := range families {
+			mf, ok := mfs[family.GetName()]
+			if !ok {
+				mfs[family.GetName()] = family
+				names = append(names, family.GetName())
+				continue
+			}
+			if mf.GetType() != family.GetType() {
+				level.Warn(p.logger).Log("msg", "metric_type_conflict", "name", family.GetName())
+				continue
+			}
+			mf.Metric = append(mf.Metric, family.GetMetric()...)
+		}
+	}
+	sort.Strings(names)
+
+	metrics := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, mfs[name])
+	}
+	return metrics, nil
+}
+
+// probe runs the prober of the module and returns the metrics of its registry with the labels target and module
+func (p *Collector) probe(j *job) []*dto.MetricFamily {
+	module := j.module
+
+	timeout := time.Duration(p.Timeout)
+	if module.Timeout > 0 {
+		timeout = module.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	probeSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Displays whether or not the probe was a success",
+	})
+	probeDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Returns how long the probe took to complete in seconds",
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccessGauge, probeDurationGauge)
+
+	logger := log.With(p.logger, labelModule, j.moduleName, labelTarget, j.target)
+
+	start := time.Now()
+	success := Probers[module.Prober](ctx, j.target, module, registry, probeLogger{next: logger})
+	duration := time.Since(start).Seconds()
+	probeDurationGauge.Set(duration)
+	if success {
+		probeSuccessGauge.Set(1)
+		level.Debug(logger).Log("msg", "probe_succeeded", "duration_seconds", duration)
+	} else {
+		level.Debug(logger).Log("msg", "probe_failed", "duration_seconds", duration)
+	}
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		level.Error(logger).Log("msg", "gather_probe_registry_failed", "error", err)
+	}
+
+	// the labels of the prober, such as phase, are not overwritten
+	labels := p.probeLabels(j)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, label := range labels {
+				if !hasLabel(m, label.GetName()) {
+					m.Label = append(m.Label, label)
+				}
+			}
+		}
+	}
+	return mfs
+}
+
+func hasLabel(metric *dto.Metric, name string) bool {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// probeLabels returns the tags, the labels of the probe, the target and the module
+func (p *Collector) probeLabels(j *job) []*dto.LabelPair {
+	values := make(map[string]string, len(p.Tags)+len(j.labels)+2)
+	for k, v := range p.Tags {
+		values[k] = v
+	}
+	for k, v := range j.labels {
+		values[k] = v
+	}
+	values[labelTarget] = j.target
+	values[labelModule] = j.moduleName
+
+	var labels []*dto.LabelPair
+	for k, v := range values {
+		key, value := k, v
+		labels = append(labels, &dto.LabelPair{Name: &key, Value: &value})
+	}
+	sort.Slice(labels, func(i, k int) bool { return labels[i].GetName() < labels[k].GetName() })
+	return labels
+}
+
+// probeLogger logs the logs of the probers in debug, a failed probe is not an error of the agent
+type probeLogger struct {
+	next log.Logger
+}
+
+func (p probeLogger) Log(keyvals ...interface{}) error {
+	kvs := make([]interface{}, len(keyvals))
+	copy(kvs, keyvals)
+	for i := 0; i < len(kvs); i += 2 {
+		if kvs[i] == level.Key() {
+			kvs[i+1] = level.DebugValue()
+		}
+	}
+	return p.next.Log(kvs...)
+}
+
+// check returns an error if a probe uses an unknown module or a module uses an unknown prober
+func (p *Collector) check() error {
+	modules := p.modules()
+	if len(modules) == 0 {
+		return fmt.Errorf("modules of the input or blackbox_probe are required")
+	}
+	for name, module := range modules {
+		if _, ok := Probers[module.Prober]; !ok {
+			return fmt.Errorf("unknown prober %q of the module %s", module.Prober, name)
+		}
+	}
+	for i, probe := range p.Probes {
+		if len(probe.Targets) == 0 || len(probe.Modules) == 0 {
+			return fmt.Errorf("targets and modules of probes[%d] are required", i)
+		}
+		for _, name := range probe.Modules {
+			if _, ok := modules[name]; !ok {
+				return fmt.Errorf("unknown module %q of probes[%d]", name, i)
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	inputs.RegisterFactory("blackbox", func(opts ...plugins.Option) (plugins.InputMetricsCollector, error) {
+
+		options := &plugins.Options{}
+		for _, o := range opts {
+			o(options)
+		}
+
+		p := &Collector{
+			logger: options.Logger,
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := p.check(); err != nil {
+			return nil, err
+		}
+
+		if p.Timeout <= 0 {
+			p.Timeout = types.Duration(defaultTimeout)
+		}
+		if p.MaxConcurrency <= 0 {
+			p.MaxConcurrency = defaultConcurrency
+		}
+
+		return p, nil
+	})
+}
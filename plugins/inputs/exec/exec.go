@@ -0,0 +1,340 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/parsers"
+	"trellis.tech/kolekti/prome_exporters/parsers/defaults"
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/inputs"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/config"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultConcurrency = 4
+	// waitDelay is the time to wait for the output after the command is killed,
+	// the children of the command may keep the pipes opened
+	waitDelay = time.Second
+	// maxErrMsgLen is the max length of stderr in the error
+	maxErrMsgLen = 1024
+)
+
+var (
+	metricExitCodeName = "exec_exit_code"
+
+	labelCommand = "command"
+)
+
+// Command is a command to be run, its stdout is parsed by the parser
+type Command struct {
+	// Name is the value of the label command, defaults the base name of the executable
+	Name string `yaml:"name" json:"name"`
+	// Command is the executable and the arguments, it is not run by a shell
+	Command []string `yaml:"command" json:"command"`
+	// Env is added to the environment of the agent
+	Env map[string]string `yaml:"env" json:"env"`
+	// Dir is the working directory, defaults the one of the agent
+	Dir string `yaml:"dir" json:"dir"`
+	// Timeout defaults the timeout of the input
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+	// Parser defaults the parser of the input
+	Parser *parsers.Config `yaml:"parser" json:"parser"`
+	// IgnoreStderr does not treat the output of stderr as an error
+	IgnoreStderr bool `yaml:"ignore_stderr" json:"ignore_stderr"`
+
+	Tags map[string]string `yaml:"tags" json:"tags"`
+
+	parser parsers.Parser
+}
+
+type Collector struct {
+	logger log.Logger
+
+	Commands []*Command `yaml:"commands" json:"commands"`
+	// Timeout of a command, defaults 10s
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+	// MaxConcurrency is the number of commands run at the same time, defaults 4
+	MaxConcurrency int `yaml:"max_concurrency" json:"max_concurrency"`
+
+	Tags map[string]string `yaml:"tags" json:"tags"`
+
+	Parser parsers.Config `yaml:"parser" json:"parser"`
+}
+
+// SampleConfig returns the sample config
+func (*Collector) SampleConfig() string {
+	return ``
+}
+
+// Description returns the description
+func (*Collector) Description() string {
+	return `Runs the commands and parses their stdout`
+}
+
+type result struct {
+	metrics  map[string]*dto.MetricFamily
+	exitCode int
+	err      error
+}
+
+// Gather runs all the commands concurrently, a command failed is reported by the metric exec_exit_code
+// and the returned error, the metrics of the others are returned with it
+func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
+	var (
+		results = make([]*result, len(p.Commands))
+		sem     = make(chan struct{}, p.MaxConcurrency)
+		wg      sync.WaitGroup
+	)
+	for i, cmd := range p.Commands {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, cmd *Command) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = p.gatherCommand(cmd)
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	mfs := make(map[string]*dto.MetricFamily)
+	exitCode := newGauge(metricExitCodeName, "The exit code of the command, -1 if it is not exited.")
+	var errs []string
+	for i, res := range results {
+		name := p.Commands[i].Name
+		if res.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, res.err))
+		}
+		code := float64(res.exitCode)
+		exitCode.Metric = append(exitCode.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: &labelCommand, Value: &name}},
+			Gauge: &dto.Gauge{Value: &code},
+		})
+
+		for name, family := range res.metrics {
+			mf, ok := mfs[name]
+			if !ok {
+				mfs[name] = family
+				continue
+			}
+			if mf.GetType() != family.GetType() {
+				level.Warn(p.logger).Log("msg", "metric_type_conflicts", "command", p.Commands[i].Name, "metric", name)
+				continue
+			}
+			mf.Metric = append(mf.Metric, family.GetMetric()...)
+		}
+	}
+
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]*dto.MetricFamily, 0, len(names)+1)
+	for _, name := range names {
+		metrics = append(metrics, mfs[name])
+	}
+	metrics = append(metrics, exitCode)
+
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%d of %d commands failed: %s", len(errs), len(p.Commands), strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+func (p *Collector) gatherCommand(cmd *Command) *result {
+	res := &result{exitCode: -1}
+
+	stdout, exitCode, err := p.run(cmd)
+	res.exitCode = exitCode
+	if err != nil {
+		level.Error(p.logger).Log("msg", "run_command_failed", "command", cmd.Name, "exit_code", exitCode, "error", err)
+		res.err = err
+		return res
+	}
+
+	tags := make(map[string]string)
+	if p.Tags != nil {
+		tags = config.DeepCopy(p.Tags).(map[string]string)
+	}
+	for k, v := range cmd.Tags {
+		tags[k] = v
+	}
+	tags[labelCommand] = cmd.Name
+
+	res.metrics, err = cmd.parser.Parse(stdout, tags, "")
+	if err != nil {
+		level.Error(p.logger).Log("msg", "parse_command_output_failed", "command", cmd.Name, "error", err)
+		res.err = fmt.Errorf("parse output failed: %w", err)
+	}
+	return res
+}
+
+// run returns the stdout and the exit code of the command, a non-zero exit code or
+// the output of stderr is an error
+func (p *Collector) run(cmd *Command) ([]byte, int, error) {
+	timeout := time.Duration(p.Timeout)
+	if cmd.Timeout > 0 {
+		timeout = time.Duration(cmd.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c := exec.CommandContext(ctx, cmd.Command[0], cmd.Command[1:]...)
+	c.Dir = cmd.Dir
+	if len(cmd.Env) > 0 {
+		c.Env = os.Environ()
+		for k, v := range cmd.Env {
+			c.Env = append(c.Env, k+"="+v)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	if err := c.Start(); err != nil {
+		return nil, -1, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// the command is killed by the context, wait for its output to be closed
+		select {
+		case err = <-done:
+		case <-time.After(waitDelay):
+			return nil, -1, fmt.Errorf("timeout after %s, the output is not closed", timeout)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, -1, fmt.Errorf("timeout after %s", timeout)
+	}
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, -1, err
+		}
+		exitCode = exitErr.ExitCode()
+		return nil, exitCode, fmt.Errorf("exit status %d: %s", exitCode, firstLine(stderr.Bytes()))
+	}
+
+	if stderr.Len() > 0 && !cmd.IgnoreStderr {
+		return nil, exitCode, fmt.Errorf("stderr: %s", firstLine(stderr.Bytes()))
+	}
+	return stdout.Bytes(), exitCode, nil
+}
+
+func firstLine(bs []byte) string {
+	if len(bs) > maxErrMsgLen {
+		bs = bs[:maxErrMsgLen]
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	if scanner.Scan() {
+		return strings.TrimSpace(scanner.Text())
+	}
+	return ""
+}
+
+func newGauge(name, help string) *dto.MetricFamily {
+	typ := dto.MetricType_GAUGE
+	return &dto.MetricFamily{
+		Name: &name,
+		Help: &help,
+		Type: &typ,
+	}
+}
+
+func init() {
+	inputs.RegisterFactory("exec", func(opts ...plugins.Option) (_ plugins.InputMetricsCollector, err error) {
+
+		options := &plugins.Options{}
+		for _, o := range opts {
+			o(options)
+		}
+
+		p := &Collector{
+			logger: options.Logger,
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		if p.Timeout <= 0 {
+			p.Timeout = types.Duration(defaultTimeout)
+		}
+		if p.MaxConcurrency <= 0 {
+			p.MaxConcurrency = defaultConcurrency
+		}
+
+		names := make(map[string]bool)
+		for i, cmd := range p.Commands {
+			if cmd == nil || len(cmd.Command) == 0 || cmd.Command[0] == "" {
+				return nil, fmt.Errorf("command %d of exec is empty", i)
+			}
+			if cmd.Name == "" {
+				cmd.Name = filepath.Base(cmd.Command[0])
+			}
+			if names[cmd.Name] {
+				return nil, fmt.Errorf("duplicate command name: %s", cmd.Name)
+			}
+			names[cmd.Name] = true
+
+			parserConfig := p.Parser
+			if cmd.Parser != nil {
+				parserConfig = *cmd.Parser
+			}
+			cmd.parser, err = defaults.NewParser(log.With(p.logger, "parser", parserConfig.Name), parserConfig)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return p, nil
+	})
+}
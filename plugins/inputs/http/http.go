@@ -20,10 +20,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"trellis.tech/kolekti/prome_exporters/internal"
+	"trellis.tech/kolekti/prome_exporters/internal/auth"
+	"trellis.tech/kolekti/prome_exporters/internal/discovery"
 	"trellis.tech/kolekti/prome_exporters/parsers"
 	"trellis.tech/kolekti/prome_exporters/parsers/defaults"
 	"trellis.tech/kolekti/prome_exporters/plugins"
@@ -32,7 +36,6 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	dto "github.com/prometheus/client_model/go"
-	"trellis.tech/trellis/common.v1/config"
 	"trellis.tech/trellis/common.v1/crypto/tls"
 	"trellis.tech/trellis/common.v1/types"
 )
@@ -40,25 +43,51 @@ import (
 var (
 	maxErrMsgLen int64 = 1024
 
-	defaultTimeout = 10 * time.Second
-	labelInstance  = "instance"
+	defaultTimeout     = 10 * time.Second
+	defaultConcurrency = 4
+	defaultScheme      = "http"
+	defaultMetricsPath = "/metrics"
+
+	labelInstance = "instance"
+	labelURL      = "url"
+
+	metricUpName             = "up"
+	metricScrapeDurationName = "scrape_duration_seconds"
+	metricSamplesScrapedName = "scrape_samples_scraped"
+	metricResponseSizeName   = "scrape_response_size_bytes"
 )
 
 type Collector struct {
 	client *http.Client
 	logger log.Logger
 
-	Timeout types.Duration    `yaml:"timeout" json:"timeout"`
-	Urls    []string          `yaml:"urls" json:"urls"`
-	Headers map[string]string `yaml:"headers" json:"headers"`
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+	// Urls are scraped by GET, the same as the targets with the url only
+	Urls    []string  `yaml:"urls" json:"urls"`
+	Targets []*Target `yaml:"targets" json:"targets"`
+	// MaxConcurrency is the number of urls scraped at the same time, defaults 4
+	MaxConcurrency int               `yaml:"max_concurrency" json:"max_concurrency"`
+	Headers        map[string]string `yaml:"headers" json:"headers"`
 
 	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
 
+	Auth auth.Config `yaml:",inline" json:",inline"`
+
 	Tags map[string]string `yaml:"tags" json:"tags"`
 
 	Parser parsers.Config `yaml:"parser" json:"parser"`
 
+	// Discovery discovers the targets scraped with the urls and the targets
+	Discovery discovery.Config `yaml:",inline" json:",inline"`
+	// RelabelConfigs rewrite the labels of the targets discovered, then the labels prefixed by "__" are dropped
+	RelabelConfigs []*discovery.RelabelConfig `yaml:"relabel_configs" json:"relabel_configs"`
+	// Scheme and MetricsPath make the urls of the targets discovered, defaults http and /metrics,
+	// overridden by the labels __scheme__ and __metrics_path__
+	Scheme      string `yaml:"scheme" json:"scheme"`
+	MetricsPath string `yaml:"metrics_path" json:"metrics_path"`
+
 	parser parsers.Parser
+	sd     *discovery.Manager
 }
 
 // SampleConfig returns the sample config
@@ -71,22 +100,112 @@ func (*Collector) Description() string {
 	return ``
 }
 
-// Gather ...
-func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
+// Start starts the discovery, the targets are discovered before the first gather
+func (p *Collector) Start() error {
+	if p.sd != nil {
+		p.sd.Start()
+	}
+	return nil
+}
 
-	mfs := make(map[string]*dto.MetricFamily)
-	for _, urlStr := range p.Urls {
-		urlP, err := url.Parse(urlStr)
-		if err != nil {
-			level.Error(p.logger).Log("msg", "parse_url_failed", "url", urlStr, "error", err)
+// Stop stops the discovery
+func (p *Collector) Stop() {
+	if p.sd != nil {
+		p.sd.Stop()
+	}
+}
+
+// discoveredTargets returns the targets discovered and relabeled, the targets without __address__ are ignored
+func (p *Collector) discoveredTargets() []*Target {
+	if p.sd == nil {
+		return nil
+	}
+
+	var targets []*Target
+	for _, labels := range p.sd.Targets() {
+		labels = discovery.Relabel(labels, p.RelabelConfigs)
+		if labels == nil || labels[discovery.AddressLabel] == "" {
 			continue
 		}
-		mfsServer, err := p.gatherServer(urlP)
-		if err != nil {
-			level.Error(p.logger).Log("msg", "gather_server_failed", "url", urlStr, "error", err)
+
+		scheme, path := p.Scheme, p.MetricsPath
+		if v := labels[discovery.SchemeLabel]; v != "" {
+			scheme = v
+		}
+		if v := labels[discovery.MetricsPathLabel]; v != "" {
+			path = v
+		}
+
+		target := &Target{
+			URL:    scheme + "://" + labels[discovery.AddressLabel] + path,
+			Labels: make(map[string]string),
+		}
+		for k, v := range labels {
+			if !strings.HasPrefix(k, discovery.ReservedLabelPrefix) {
+				target.Labels[k] = v
+			}
+		}
+		if err := target.init(); err != nil {
+			level.Warn(p.logger).Log("msg", "invalid_target_discovered", "url", target.URL, "error", err)
 			continue
 		}
-		for name, family := range mfsServer {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// scrapeResult is the result of an url
+type scrapeResult struct {
+	target   *Target
+	url      string
+	instance string
+	metrics  map[string]*dto.MetricFamily
+	size     int
+	duration time.Duration
+	err      error
+}
+
+// Gather scrapes the urls concurrently, an url failed is reported by the metric up and the
+// returned error, the metrics of the others are returned with it
+func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
+	targets := append(p.discoveredTargets(), p.Targets...)
+	var (
+		results = make([]*scrapeResult, len(targets))
+		sem     = make(chan struct{}, p.MaxConcurrency)
+		wg      sync.WaitGroup
+	)
+	for i, target := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, target *Target) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = p.scrape(target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	var (
+		mfs  = make(map[string]*dto.MetricFamily)
+		up   = newGauge(metricUpName, "1 if the url is scraped successfully, 0 otherwise.")
+		dur  = newGauge(metricScrapeDurationName, "Duration of the scrape in seconds.")
+		samp = newGauge(metricSamplesScrapedName, "The number of samples the url exposed.")
+		size = newGauge(metricResponseSizeName, "The size of the response body in bytes.")
+		errs []string
+	)
+	for _, res := range results {
+		var upValue, samples float64
+		if res.err == nil {
+			upValue = 1
+		} else {
+			level.Error(p.logger).Log("msg", "gather_server_failed", "url", res.url, "error", res.err)
+			errs = append(errs, fmt.Sprintf("%s: %v", res.url, res.err))
+		}
+
+		for name, family := range res.metrics {
+			samples += float64(len(family.GetMetric()))
 			mf, ok := mfs[name]
 			if !ok {
 				mfs[name] = family
@@ -94,25 +213,106 @@ func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
 			}
 			mf.Metric = append(mf.Metric, family.GetMetric()...)
 		}
+
+		labels := p.scrapeLabels(res)
+		addGauge(up, upValue, labels)
+		addGauge(dur, res.duration.Seconds(), labels)
+		addGauge(samp, samples, labels)
+		addGauge(size, float64(res.size), labels)
+	}
+
+	// the families are sorted, so the output is the same at every gather
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]*dto.MetricFamily, 0, len(names)+4)
+	for _, name := range names {
+		metrics = append(metrics, mfs[name])
+	}
+	// the families without metrics are invalid, such as no target is discovered yet
+	if len(results) > 0 {
+		metrics = append(metrics, up, dur, samp, size)
 	}
 
-	var metrics []*dto.MetricFamily
-	for _, family := range mfs {
-		metrics = append(metrics, family)
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%d of %d urls failed: %s", len(errs), len(targets), strings.Join(errs, "; "))
 	}
 	return metrics, nil
 }
 
-func (p *Collector) gatherServer(urlP *url.URL) (map[string]*dto.MetricFamily, error) {
+func (p *Collector) scrape(target *Target) *scrapeResult {
+	res := &scrapeResult{target: target, url: target.name}
+
+	start := time.Now()
+	req, urlP, err := target.newRequest(start, p.Headers)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	res.url = urlP.Redacted()
+	res.instance = urlP.Host
+	if instance, ok := target.Labels[labelInstance]; ok {
+		res.instance = instance
+	}
+
+	res.metrics, res.size, res.err = p.gatherServer(req, p.targetTags(target, res.instance))
+	res.duration = time.Since(start)
+	return res
+}
+
+// targetTags returns the tags of the metrics of the target, the labels of the target override the tags
+func (p *Collector) targetTags(target *Target, instance string) map[string]string {
+	// targets are scraped concurrently, so the tags are copied rather than shared
+	tags := make(map[string]string, len(p.Tags)+len(target.Labels)+1)
+	for k, v := range p.Tags {
+		tags[k] = v
+	}
+	for k, v := range target.Labels {
+		tags[k] = v
+	}
+	tags[labelInstance] = instance
+	return tags
+}
+
+// scrapeLabels returns the labels of the metrics of the scrape, the tags, the labels of the target,
+// the instance and the url configured, which is not changed by the templates
+func (p *Collector) scrapeLabels(res *scrapeResult) []*dto.LabelPair {
+	var labels []*dto.LabelPair
+	for k, v := range p.targetTags(res.target, res.instance) {
+		if k == labelInstance || k == labelURL {
+			continue
+		}
+		key, value := k, v
+		labels = append(labels, &dto.LabelPair{Name: &key, Value: &value})
+	}
+	instance, u := res.instance, res.target.name
+	return append(labels,
+		&dto.LabelPair{Name: &labelInstance, Value: &instance},
+		&dto.LabelPair{Name: &labelURL, Value: &u})
+}
 
-	req, _ := http.NewRequest("GET", urlP.String(), nil)
-	for key, value := range p.Headers {
-		req.Header.Set(key, value)
+func newGauge(name, help string) *dto.MetricFamily {
+	typ := dto.MetricType_GAUGE
+	return &dto.MetricFamily{
+		Name: &name,
+		Help: &help,
+		Type: &typ,
 	}
+}
+
+func addGauge(mf *dto.MetricFamily, value float64, labels []*dto.LabelPair) {
+	mf.Metric = append(mf.Metric, &dto.Metric{
+		Label: labels,
+		Gauge: &dto.Gauge{Value: &value},
+	})
+}
+
+func (p *Collector) gatherServer(req *http.Request, tags map[string]string) (map[string]*dto.MetricFamily, int, error) {
 	resp, err := p.client.Do(req)
 	if err != nil {
-		// todo log
-		return nil, err
+		return nil, 0, err
 	}
 	defer internal.IOClose(resp.Body)
 
@@ -122,24 +322,16 @@ func (p *Collector) gatherServer(urlP *url.URL) (map[string]*dto.MetricFamily, e
 		if scanner.Scan() {
 			errorLine = scanner.Text()
 		}
-		err := fmt.Errorf("when writing to [%s] received status code: %d. body: %s", urlP.String(), resp.StatusCode, errorLine)
-		level.Error(p.logger).Log("error", err)
-		return nil, err
+		return nil, 0, fmt.Errorf("when reading [%s] received status code: %d. body: %s", req.URL.Redacted(), resp.StatusCode, errorLine)
 	}
 
 	bs, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
-	}
-
-	tags := make(map[string]string)
-	if p.Tags != nil {
-		tags = config.DeepCopy(p.Tags).(map[string]string)
+		return nil, len(bs), err
 	}
 
-	tags[labelInstance] = urlP.Host
-
-	return p.parser.Parse(bs, tags, resp.Header.Get("Content-Type"))
+	mfs, err := p.parser.Parse(bs, tags, resp.Header.Get("Content-Type"))
+	return mfs, len(bs), err
 }
 
 func init() {
@@ -160,6 +352,36 @@ func init() {
 			}
 		}
 
+		for _, urlStr := range p.Urls {
+			p.Targets = append(p.Targets, &Target{URL: urlStr})
+		}
+		for _, target := range p.Targets {
+			if err := target.init(); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, cfg := range p.RelabelConfigs {
+			if err := cfg.Compile(); err != nil {
+				return nil, err
+			}
+		}
+		if !p.Discovery.Empty() {
+			if p.Scheme == "" {
+				p.Scheme = defaultScheme
+			}
+			if p.MetricsPath == "" {
+				p.MetricsPath = defaultMetricsPath
+			}
+			if p.sd, err = discovery.NewManager(p.Discovery, log.With(p.logger, "component", "discovery")); err != nil {
+				return nil, err
+			}
+		}
+
+		if p.MaxConcurrency <= 0 {
+			p.MaxConcurrency = defaultConcurrency
+		}
+
 		timeout := defaultTimeout
 		if p.Timeout != 0 {
 			timeout = time.Duration(p.Timeout)
@@ -177,9 +399,14 @@ func init() {
 			transport.TLSClientConfig = tlsConfig
 		}
 
+		roundTripper, err := p.Auth.NewRoundTripper(transport)
+		if err != nil {
+			return nil, err
+		}
+
 		p.client = &http.Client{
 			Timeout:   timeout,
-			Transport: transport,
+			Transport: roundTripper,
 		}
 
 		p.parser, err = defaults.NewParser(log.With(p.logger, "parser", p.Parser.Name), p.Parser)
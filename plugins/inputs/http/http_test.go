@@ -0,0 +1,151 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"trellis.tech/kolekti/prome_exporters/internal/discovery"
+	"trellis.tech/kolekti/prome_exporters/parsers"
+	"trellis.tech/kolekti/prome_exporters/parsers/defaults"
+
+	"github.com/go-kit/log"
+)
+
+func TestDiscoveredTargets(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "targets.json")
+	err := ioutil.WriteFile(filename, []byte(`[
+		{"targets": ["10.0.0.1:9404", ""], "labels": {"service": "kafka", "__metrics_path__": "/prom"}},
+		{"targets": ["10.0.0.2:9100"], "labels": {"env": "staging"}},
+		{"targets": ["10.0.0.3:9100"], "labels": {"__scheme__": "https"}}
+	]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Collector{
+		logger:      log.NewNopLogger(),
+		Scheme:      defaultScheme,
+		MetricsPath: defaultMetricsPath,
+		RelabelConfigs: []*discovery.RelabelConfig{
+			{Action: discovery.RelabelDrop, SourceLabels: []string{"env"}, Regex: "staging"},
+			{SourceLabels: []string{discovery.AddressLabel}, Regex: `([^:]+):\d+`, TargetLabel: "host"},
+		},
+	}
+	if targets := p.discoveredTargets(); targets != nil {
+		t.Errorf("unexpected targets without the discovery: %v", targets)
+	}
+
+	for _, cfg := range p.RelabelConfigs {
+		if err := cfg.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.sd, err = discovery.NewManager(discovery.Config{
+		FileSDConfigs: []*discovery.FileSDConfig{{Files: []string{filepath.Join(dir, "*.json")}}},
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.sd.Start()
+	defer p.sd.Stop()
+
+	targets := p.discoveredTargets()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].URL < targets[j].URL })
+
+	expected := []*Target{
+		{URL: "http://10.0.0.1:9404/prom", Labels: map[string]string{"service": "kafka", "host": "10.0.0.1"}},
+		{URL: "https://10.0.0.3:9100/metrics", Labels: map[string]string{"host": "10.0.0.3"}},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("unexpected targets: %d, expected %d", len(targets), len(expected))
+	}
+	for i, target := range targets {
+		if target.URL != expected[i].URL || !reflect.DeepEqual(target.Labels, expected[i].Labels) {
+			t.Errorf("unexpected target %s %v, expected %s %v", target.URL, target.Labels, expected[i].URL, expected[i].Labels)
+		}
+		if target.Method != "GET" || target.name != expected[i].URL {
+			t.Errorf("target %s is not initialized", target.URL)
+		}
+	}
+}
+
+func newTestCollector(t *testing.T, urls ...string) *Collector {
+	parser, err := defaults.NewParser(log.NewNopLogger(), parsers.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Collector{
+		logger:         log.NewNopLogger(),
+		client:         &http.Client{},
+		parser:         parser,
+		MaxConcurrency: defaultConcurrency,
+	}
+	for _, u := range urls {
+		target := &Target{URL: u}
+		if err := target.init(); err != nil {
+			t.Fatal(err)
+		}
+		p.Targets = append(p.Targets, target)
+	}
+	return p
+}
+
+func TestGatherWithoutTargets(t *testing.T) {
+	mfs, err := newTestCollector(t).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 0 {
+		t.Errorf("unexpected families without targets: %v", mfs)
+	}
+}
+
+func TestGatherSorted(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "c_total 1\na 2\nb 3\n")
+	}))
+	defer ts.Close()
+
+	p := newTestCollector(t, ts.URL+"/metrics")
+	for i := 0; i < 3; i++ {
+		mfs, err := p.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, mf := range mfs {
+			if len(mf.GetMetric()) == 0 {
+				t.Errorf("unexpected empty family %s", mf.GetName())
+			}
+			names = append(names, mf.GetName())
+		}
+		expected := []string{"a", "b", "c_total", metricUpName, metricScrapeDurationName, metricSamplesScrapedName, metricResponseSizeName}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("unexpected families %v, expected %v", names, expected)
+		}
+		if up := mfs[3].GetMetric()[0].GetGauge().GetValue(); up != 1 {
+			t.Errorf("unexpected up %v", up)
+		}
+	}
+}
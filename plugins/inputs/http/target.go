@@ -0,0 +1,112 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Target is an url scraped by the input, the url and the body are the templates executed with
+// the templateData at every scrape, for example: end={{ .Now.Unix }}
+type Target struct {
+	URL     string            `yaml:"url" json:"url"`
+	Method  string            `yaml:"method" json:"method"`
+	Body    string            `yaml:"body" json:"body"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	// Labels are added to the metrics of the target, override the tags and the instance
+	Labels map[string]string `yaml:"labels" json:"labels"`
+
+	urlTemplate  *template.Template
+	bodyTemplate *template.Template
+	// name is the url configured with the password redacted, used as the label url
+	name string
+}
+
+// templateData is the data of the url and the body templates
+type templateData struct {
+	Now time.Time
+}
+
+var templateFuncs = template.FuncMap{
+	"unix":   func(t time.Time) int64 { return t.Unix() },
+	"unixMs": func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) },
+}
+
+func (t *Target) init() (err error) {
+	if t.URL == "" {
+		return fmt.Errorf("url of the target is empty")
+	}
+	t.Method = strings.ToUpper(t.Method)
+	if t.Method == "" {
+		t.Method = http.MethodGet
+	}
+
+	if t.urlTemplate, err = template.New("url").Funcs(templateFuncs).Parse(t.URL); err != nil {
+		return fmt.Errorf("parse url template of %q failed: %w", t.URL, err)
+	}
+	if t.Body != "" {
+		if t.bodyTemplate, err = template.New("body").Funcs(templateFuncs).Parse(t.Body); err != nil {
+			return fmt.Errorf("parse body template of %q failed: %w", t.URL, err)
+		}
+	}
+
+	t.name = t.URL
+	if urlP, err := url.Parse(t.URL); err == nil {
+		t.name = urlP.Redacted()
+	}
+	return nil
+}
+
+// newRequest executes the templates and returns the request of the target
+func (t *Target) newRequest(now time.Time, headers map[string]string) (*http.Request, *url.URL, error) {
+	data := &templateData{Now: now}
+
+	buf := &bytes.Buffer{}
+	if err := t.urlTemplate.Execute(buf, data); err != nil {
+		return nil, nil, fmt.Errorf("execute url template failed: %w", err)
+	}
+	urlP, err := url.Parse(buf.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body io.Reader
+	if t.bodyTemplate != nil {
+		bodyBuf := &bytes.Buffer{}
+		if err := t.bodyTemplate.Execute(bodyBuf, data); err != nil {
+			return nil, nil, fmt.Errorf("execute body template failed: %w", err)
+		}
+		body = bodyBuf
+	}
+
+	req, err := http.NewRequest(t.Method, urlP.String(), body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	for key, value := range t.Headers {
+		req.Header.Set(key, value)
+	}
+	return req, urlP, nil
+}
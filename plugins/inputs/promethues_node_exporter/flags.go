@@ -0,0 +1,207 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package promethues_node_exporter
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const collectorFlagPrefix = "collector."
+
+// the flags of node_exporter set by the options
+const (
+	flagProcFS             = "path.procfs"
+	flagSysFS              = "path.sysfs"
+	flagRootFS             = "path.rootfs"
+	flagTextfileDirectory  = "collector.textfile.directory"
+	flagMountPointsExclude = "collector.filesystem.mount-points-exclude"
+	flagFSTypesExclude     = "collector.filesystem.fs-types-exclude"
+)
+
+var (
+	flagsMu sync.Mutex
+	// baseline is the state of the collectors before any input enables one
+	baseline map[string]bool
+	// appliedFlags are the values of the flags which are set by the inputs
+	appliedFlags = make(map[string]string)
+)
+
+// collectorStates returns the states of the collectors registered by node_exporter,
+// the flags as "--collector.<name>"
+func collectorStates() map[string]bool {
+	states := make(map[string]bool)
+	for _, flag := range kingpin.CommandLine.Model().Flags {
+		if !flag.IsBoolFlag() || !strings.HasPrefix(flag.Name, collectorFlagPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(flag.Name, collectorFlagPrefix)
+		if strings.Contains(name, ".") || name == "disable-defaults" {
+			continue
+		}
+		states[name] = flag.Value.String() == "true"
+	}
+	return states
+}
+
+// flagValue is a value of a flag of node_exporter set by an input
+type flagValue struct {
+	name, value string
+}
+
+// setFlags sets the flags of node_exporter. Different values of a flag between the node inputs
+// are not supported: the flags are global in node_exporter, which reads some of them when a
+// collector is created, such as the textfile directory and the filesystem excludes, and caches
+// the collectors by name for the process, so an input can't get the collectors of its own values.
+// All the flags are checked before any of them is set, so a conflict mutates nothing,
+// and the flags set are restored if one of them fails.
+func setFlags(values []flagValue) error {
+	var flags []*kingpin.FlagClause
+	for _, v := range values {
+		if applied, ok := appliedFlags[v.name]; ok && applied != v.value {
+			return fmt.Errorf("different values of --%s between prometheus_node_exporter inputs are not supported: "+
+				"%s is set, but %s is already set by another input", v.name, v.value, applied)
+		}
+		flag := kingpin.CommandLine.GetFlag(v.name)
+		if flag == nil {
+			return fmt.Errorf("unknown node_exporter flag: %s", v.name)
+		}
+		flags = append(flags, flag)
+	}
+
+	previous := make([]string, len(values))
+	for i, v := range values {
+		previous[i] = flags[i].Model().Value.String()
+		if err := flags[i].Model().Value.Set(v.value); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				_ = flags[j].Model().Value.Set(previous[j])
+			}
+			return fmt.Errorf("invalid node_exporter flag --%s=%s: %v", v.name, v.value, err)
+		}
+	}
+	for _, v := range values {
+		appliedFlags[v.name] = v.value
+	}
+	return nil
+}
+
+func (p *Config) validate(states map[string]bool) error {
+	for _, name := range append(append(append([]string{}, p.Filters...), p.Collectors.Enable...), p.Collectors.Disable...) {
+		if _, ok := states[name]; !ok {
+			return fmt.Errorf("unknown node_exporter collector: %s", name)
+		}
+	}
+	for _, name := range p.Collectors.Enable {
+		for _, disable := range p.Collectors.Disable {
+			if name == disable {
+				return fmt.Errorf("collector %s is both enabled and disabled", name)
+			}
+		}
+	}
+
+	for _, path := range []string{p.Path.ProcFS, p.Path.SysFS, p.Path.RootFS, p.Textfile.Directory} {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("not a directory: %s", path)
+		}
+	}
+
+	for _, expr := range []string{p.Filesystem.MountPointsExclude, p.Filesystem.FSTypesExclude} {
+		if expr == "" {
+			continue
+		}
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("invalid filesystem exclude %q: %v", expr, err)
+		}
+	}
+	return nil
+}
+
+// apply validates the config, sets the flags of node_exporter and returns the collectors
+// of the input, which are passed to collector.NewNodeCollector as the filters.
+func (p *Config) apply() ([]string, error) {
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+
+	if baseline == nil {
+		baseline = collectorStates()
+	}
+	if err := p.validate(baseline); err != nil {
+		return nil, err
+	}
+
+	var values []flagValue
+	for _, v := range []flagValue{
+		{flagProcFS, p.Path.ProcFS},
+		{flagSysFS, p.Path.SysFS},
+		{flagRootFS, p.Path.RootFS},
+		{flagTextfileDirectory, p.Textfile.Directory},
+		{flagMountPointsExclude, p.Filesystem.MountPointsExclude},
+		{flagFSTypesExclude, p.Filesystem.FSTypesExclude},
+	} {
+		if v.value != "" {
+			values = append(values, v)
+		}
+	}
+
+	// the collectors enabled by other inputs are not collected by this input
+	collectors := make(map[string]bool)
+	if len(p.Filters) > 0 {
+		for _, name := range p.Filters {
+			collectors[name] = true
+		}
+	} else {
+		for name, enabled := range baseline {
+			collectors[name] = enabled
+		}
+	}
+	for _, name := range p.Collectors.Enable {
+		collectors[name] = true
+	}
+	for _, name := range p.Collectors.Disable {
+		delete(collectors, name)
+	}
+
+	var filters []string
+	for name, enabled := range collectors {
+		if enabled {
+			filters = append(filters, name)
+		}
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("no node_exporter collector is enabled")
+	}
+	sort.Strings(filters)
+
+	// the collectors of the input are enabled, they are not collected by the other inputs
+	// which pass their own filters
+	for _, name := range filters {
+		values = append(values, flagValue{collectorFlagPrefix + name, "true"})
+	}
+	if err := setFlags(values); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
@@ -27,13 +27,50 @@ func init() {
 	inputs.RegisterFactory("prometheus_node_exporter", NewNodeExporterCollector)
 }
 
+// Config is the options of the input. The collectors can be different between the node inputs,
+// but the paths, textfile and filesystem options are the global flags of node_exporter, an input
+// setting a value different from another input is rejected, see setFlags
+type Config struct {
+	// Filters are the only collectors of the input, defaults the enabled collectors
+	Filters    []string         `yaml:"filters" json:"filters"`
+	Collectors CollectorsConfig `yaml:"collectors" json:"collectors"`
+
+	Path       PathConfig       `yaml:"path" json:"path"`
+	Textfile   TextfileConfig   `yaml:"textfile" json:"textfile"`
+	Filesystem FilesystemConfig `yaml:"filesystem" json:"filesystem"`
+}
+
+type CollectorsConfig struct {
+	// Enable the collectors which are not enabled by default, eg: systemd, processes
+	Enable []string `yaml:"enable" json:"enable"`
+	// Disable the collectors of the input
+	Disable []string `yaml:"disable" json:"disable"`
+}
+
+type PathConfig struct {
+	ProcFS string `yaml:"procfs" json:"procfs"` // --path.procfs
+	SysFS  string `yaml:"sysfs" json:"sysfs"`   // --path.sysfs
+	RootFS string `yaml:"rootfs" json:"rootfs"` // --path.rootfs
+}
+
+type TextfileConfig struct {
+	Directory string `yaml:"directory" json:"directory"` // --collector.textfile.directory
+}
+
+type FilesystemConfig struct {
+	MountPointsExclude string `yaml:"mount_points_exclude" json:"mount_points_exclude"` // --collector.filesystem.mount-points-exclude
+	FSTypesExclude     string `yaml:"fs_types_exclude" json:"fs_types_exclude"`         // --collector.filesystem.fs-types-exclude
+}
+
 type Collector struct {
 	prometheus.Collector
+
+	host string
 }
 
 func (p *Collector) Tags() map[string]string {
 	return map[string]string{
-		"instance": internal.GetIP(),
+		"instance": p.host,
 	}
 }
 
@@ -43,12 +80,22 @@ func NewNodeExporterCollector(opts ...plugins.Option) (_ plugins.InputPrometheus
 		opt(options)
 	}
 
-	var filters []string
+	cfg := &Config{}
 	if options.Config != nil {
-		filters = options.Config.GetStringList("filters")
+		if err = options.Config.ToObject("", cfg); err != nil {
+			return
+		}
+	}
+
+	filters, err := cfg.apply()
+	if err != nil {
+		return
 	}
 
-	c := &Collector{}
+	c := &Collector{host: options.Host}
+	if c.host == "" {
+		c.host = internal.GetIP()
+	}
 	c.Collector, err = collector.NewNodeCollector(options.Logger, filters...)
 	if err != nil {
 		return
@@ -0,0 +1,151 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package statsd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	matchTypeGlob  = "glob"
+	matchTypeRegex = "regex"
+
+	actionMap  = "map"
+	actionDrop = "drop"
+)
+
+var invalidNameCharRE = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// Mapping maps a statsd name to a metric name and labels, as the mappings of statsd_exporter:
+//
+//	match: "client.*.request.count"
+//	name: "client_request_count"
+//	labels:
+//	  client: "$1"
+type Mapping struct {
+	// Match is a glob pattern, the "*" matches a component without dots, or a regex
+	Match string `yaml:"match" json:"match"`
+	// MatchType is glob or regex, defaults glob
+	MatchType string `yaml:"match_type" json:"match_type"`
+	// MatchMetricType only matches the samples of the type, counter, gauge, observer or set
+	MatchMetricType string `yaml:"match_metric_type" json:"match_metric_type"`
+	// Name of the metric, "$n" is the nth captured group
+	Name string `yaml:"name" json:"name"`
+	// Labels of the metric, "$n" is the nth captured group
+	Labels map[string]string `yaml:"labels" json:"labels"`
+	// Action is map or drop, defaults map
+	Action string `yaml:"action" json:"action"`
+
+	re *regexp.Regexp
+}
+
+func (p *Mapping) compile() (err error) {
+	if p.Match == "" {
+		return fmt.Errorf("match of the mapping is required")
+	}
+	if p.Action == "" {
+		p.Action = actionMap
+	}
+	if p.Action != actionMap && p.Action != actionDrop {
+		return fmt.Errorf("invalid action %q of the mapping %s", p.Action, p.Match)
+	}
+	if p.Action == actionMap && p.Name == "" {
+		return fmt.Errorf("name of the mapping %s is required", p.Match)
+	}
+	switch p.MatchMetricType {
+	case "", "counter", "gauge", "observer", "set":
+	default:
+		return fmt.Errorf("invalid match_metric_type %q of the mapping %s", p.MatchMetricType, p.Match)
+	}
+
+	switch p.MatchType {
+	case "", matchTypeGlob:
+		p.MatchType = matchTypeGlob
+		parts := strings.Split(p.Match, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		p.re, err = regexp.Compile("^" + strings.Join(parts, "([^.]*)") + "$")
+	case matchTypeRegex:
+		p.re, err = regexp.Compile(p.Match)
+	default:
+		return fmt.Errorf("invalid match_type %q of the mapping %s", p.MatchType, p.Match)
+	}
+	return err
+}
+
+// mapper maps the statsd names with the first matched mapping
+type mapper struct {
+	mappings []*Mapping
+}
+
+func newMapper(mappings []*Mapping) (*mapper, error) {
+	for _, m := range mappings {
+		if err := m.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &mapper{mappings: mappings}, nil
+}
+
+// mapName returns the metric name and the labels of the statsd name, ok is false
+// if the sample is dropped. The name is sanitized if no mapping matches.
+func (p *mapper) mapName(statsdName string, typ metricType) (name string, labels map[string]string, ok bool) {
+	for _, m := range p.mappings {
+		if m.MatchMetricType != "" && m.MatchMetricType != typeGroup(typ) {
+			continue
+		}
+		matches := m.re.FindStringSubmatchIndex(statsdName)
+		if matches == nil {
+			continue
+		}
+		if m.Action == actionDrop {
+			return "", nil, false
+		}
+
+		name = sanitizeName(string(m.re.ExpandString(nil, m.Name, statsdName, matches)))
+		labels = make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			labels[k] = string(m.re.ExpandString(nil, v, statsdName, matches))
+		}
+		return name, labels, true
+	}
+	return sanitizeName(statsdName), nil, true
+}
+
+// typeGroup returns the match_metric_type of the type
+func typeGroup(typ metricType) string {
+	switch typ {
+	case typeCounter:
+		return "counter"
+	case typeGauge:
+		return "gauge"
+	case typeSet:
+		return "set"
+	default:
+		return "observer"
+	}
+}
+
+// sanitizeName replaces the invalid chars of prometheus with "_"
+func sanitizeName(name string) string {
+	name = invalidNameCharRE.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package statsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// metricType is the type of a statsd sample
+type metricType string
+
+const (
+	typeCounter      metricType = "c"
+	typeGauge        metricType = "g"
+	typeTimer        metricType = "ms"
+	typeHistogram    metricType = "h"
+	typeDistribution metricType = "d"
+	typeSet          metricType = "s"
+)
+
+// minSampleRate is the lowest sample rate accepted, a sample is weighted 1/rate, so a lower rate
+// would inflate the counts out of any sane range
+const minSampleRate = 1e-6
+
+// sample is a value of a statsd line, a line may have several samples as "name:1|c:2|c"
+type sample struct {
+	name  string
+	typ   metricType
+	value float64
+	// setValue is the raw value of a set
+	setValue string
+	// relative is true if the gauge is "+n" or "-n"
+	relative bool
+	rate     float64
+	tags     map[string]string
+}
+
+// parseLine parses a line of statsd or dogstatsd:
+//
+//	<name>:<value>|<type>[|@<rate>][|#<tag>:<value>,<tag>]
+//
+// the events and service checks of dogstatsd are ignored
+func parseLine(line string) ([]*sample, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil, nil
+	}
+
+	idx := strings.Index(line, ":")
+	if idx <= 0 {
+		return nil, fmt.Errorf("no value in line: %q", line)
+	}
+	name, rest := line[:idx], line[idx+1:]
+
+	// the dogstatsd tags are shared by all the samples of the line
+	var tags map[string]string
+	if i := strings.Index(rest, "|#"); i >= 0 {
+		end := len(rest)
+		if j := strings.Index(rest[i+2:], "|"); j >= 0 {
+			end = i + 2 + j
+		}
+		tags = parseTags(rest[i+2 : end])
+		rest = rest[:i] + rest[end:]
+	}
+
+	var samples []*sample
+	for _, component := range splitSamples(rest) {
+		s, err := parseSample(name, component)
+		if err != nil {
+			return nil, fmt.Errorf("%v in line: %q", err, line)
+		}
+		s.tags = tags
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// splitSamples splits "1|c:2|c|@0.1" to "1|c" and "2|c|@0.1"
+func splitSamples(s string) []string {
+	if !strings.Contains(s, "|") {
+		return []string{s}
+	}
+	var (
+		components []string
+		start      int
+	)
+	for i := 0; i < len(s); i++ {
+		// ":" starts a new sample after the type
+		if s[i] == ':' && strings.Contains(s[start:i], "|") {
+			components = append(components, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(components, s[start:])
+}
+
+func parseSample(name, component string) (*sample, error) {
+	fields := strings.Split(component, "|")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("no type of sample %q", component)
+	}
+
+	s := &sample{name: name, typ: metricType(fields[1]), rate: 1}
+	value := fields[0]
+
+	switch s.typ {
+	case typeSet:
+		s.setValue = value
+	case typeCounter, typeGauge, typeTimer, typeHistogram, typeDistribution:
+		if s.typ == typeGauge && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")) {
+			s.relative = true
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", value)
+		}
+		s.value = v
+	default:
+		return nil, fmt.Errorf("unsupported type %q", fields[1])
+	}
+
+	for _, field := range fields[2:] {
+		if !strings.HasPrefix(field, "@") {
+			// the other extensions are ignored, eg: the container id of dogstatsd
+			continue
+		}
+		rate, err := strconv.ParseFloat(field[1:], 64)
+		if err != nil || rate < minSampleRate || rate > 1 {
+			return nil, fmt.Errorf("invalid sample rate %q", field)
+		}
+		s.rate = rate
+	}
+	return s, nil
+}
+
+// parseTags parses the dogstatsd tags, "key:value,key", the tag without a value is ignored
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags
+}
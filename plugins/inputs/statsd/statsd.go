@@ -0,0 +1,617 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package statsd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/inputs"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	protocolUDP      = "udp"
+	protocolTCP      = "tcp"
+	protocolUnixgram = "unixgram"
+
+	observerSummary   = "summary"
+	observerHistogram = "histogram"
+
+	defaultServiceAddress    = ":8125"
+	defaultMaxTCPConnections = 250
+	defaultMaxSamples        = 1000
+	// maxAcceptDelay is the max delay of accepting again after a temporary error, such as too many open files
+	maxAcceptDelay = time.Second
+	// maxPacketSize is the max size of an udp or unixgram packet
+	maxPacketSize = 65535
+)
+
+var (
+	defaultPercentiles = []float64{50, 90, 99}
+
+	invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	metricParseErrorsName = "statsd_parse_errors_total"
+)
+
+type Collector struct {
+	logger log.Logger
+
+	// Protocol is udp, tcp or unixgram, defaults udp
+	Protocol string `yaml:"protocol" json:"protocol"`
+	// ServiceAddress is the address to listen, the path of the socket for unixgram, defaults ":8125"
+	ServiceAddress string `yaml:"service_address" json:"service_address"`
+	// MaxTCPConnections is the max number of the tcp connections, defaults 250
+	MaxTCPConnections int `yaml:"max_tcp_connections" json:"max_tcp_connections"`
+	// ReadBufferSize is the size of the socket read buffer of udp and unixgram, 0 is the system default
+	ReadBufferSize int `yaml:"read_buffer_size" json:"read_buffer_size"`
+
+	// ObserverType is summary or histogram for the timers, histograms and distributions,
+	// the timers are in milliseconds and converted to seconds, defaults summary
+	ObserverType string `yaml:"observer_type" json:"observer_type"`
+	// Percentiles of the summaries, which are calculated with the samples of a flush interval, defaults 50, 90, 99
+	Percentiles []float64 `yaml:"percentiles" json:"percentiles"`
+	// MaxSamples is the max number of the samples of a summary kept in a flush interval, the samples
+	// beyond it are sampled uniformly, defaults 1000
+	MaxSamples int `yaml:"max_samples" json:"max_samples"`
+	// Buckets of the histograms, defaults the buckets of prometheus
+	Buckets []float64 `yaml:"buckets" json:"buckets"`
+
+	// TTL deletes the series which are not updated in it, 0 keeps all the series
+	TTL types.Duration `yaml:"ttl" json:"ttl"`
+
+	Mappings []*Mapping `yaml:"mappings" json:"mappings"`
+
+	Tags map[string]string `yaml:"tags" json:"tags"`
+
+	mapper *mapper
+
+	mu          sync.Mutex
+	series      map[string]*series
+	types       map[string]dto.MetricType
+	parseErrors float64
+
+	listener   net.Listener
+	packetConn net.PacketConn
+	conns      map[net.Conn]struct{}
+	wg         sync.WaitGroup
+	done       chan struct{}
+}
+
+// series is the aggregation of a metric with the labels
+type series struct {
+	name    string
+	labels  []*dto.LabelPair
+	typ     dto.MetricType
+	updated time.Time
+
+	// counter and gauge
+	value float64
+
+	// summary and histogram, the count and the sum are cumulative, the samples are
+	// a reservoir of the observations of the current flush interval
+	count    uint64
+	sum      float64
+	samples  []float64
+	observed int64
+	buckets  []uint64
+
+	// set, the unique values of the current flush interval
+	set map[string]struct{}
+}
+
+// SampleConfig returns the sample config
+func (*Collector) SampleConfig() string {
+	return ``
+}
+
+// Description returns the description
+func (*Collector) Description() string {
+	return `Listens the statsd and dogstatsd metrics, and aggregates them in a flush interval`
+}
+
+// Start listens the service address
+func (p *Collector) Start() (err error) {
+	p.done = make(chan struct{})
+
+	switch p.Protocol {
+	case protocolUDP, protocolUnixgram:
+		if p.Protocol == protocolUnixgram {
+			// remove the socket left by the last run
+			if fi, err := os.Stat(p.ServiceAddress); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				_ = os.Remove(p.ServiceAddress)
+			}
+		}
+		p.packetConn, err = net.ListenPacket(p.Protocol, p.ServiceAddress)
+		if err != nil {
+			return err
+		}
+		if p.ReadBufferSize > 0 {
+			if conn, ok := p.packetConn.(interface{ SetReadBuffer(int) error }); ok {
+				if err := conn.SetReadBuffer(p.ReadBufferSize); err != nil {
+					level.Warn(p.logger).Log("msg", "set_read_buffer_failed", "error", err)
+				}
+			}
+		}
+		p.wg.Add(1)
+		go p.readPackets()
+	case protocolTCP:
+		p.listener, err = net.Listen(p.Protocol, p.ServiceAddress)
+		if err != nil {
+			return err
+		}
+		p.conns = make(map[net.Conn]struct{})
+		p.wg.Add(1)
+		go p.acceptTCP()
+	}
+
+	level.Info(p.logger).Log("msg", "statsd_listening", "protocol", p.Protocol, "address", p.ServiceAddress)
+	return nil
+}
+
+// Stop closes the listener and the connections
+func (p *Collector) Stop() {
+	if p.done == nil {
+		return
+	}
+	close(p.done)
+
+	if p.packetConn != nil {
+		_ = p.packetConn.Close()
+	}
+	if p.listener != nil {
+		_ = p.listener.Close()
+	}
+
+	p.mu.Lock()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	if p.Protocol == protocolUnixgram {
+		_ = os.Remove(p.ServiceAddress)
+	}
+}
+
+func (p *Collector) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Collector) readPackets() {
+	defer p.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := p.packetConn.ReadFrom(buf)
+		if err != nil {
+			if p.stopped() {
+				return
+			}
+			level.Error(p.logger).Log("msg", "read_packet_failed", "error", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			p.handleLine(line)
+		}
+	}
+}
+
+// acceptTCP accepts the connections until the listener is closed, it accepts again after the
+// other errors with a delay, as net/http.Server does
+func (p *Collector) acceptTCP() {
+	defer p.wg.Done()
+
+	var delay time.Duration
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if p.stopped() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			level.Error(p.logger).Log("msg", "accept_failed", "error", err, "retry_in", delay)
+			select {
+			case <-p.done:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+
+		p.mu.Lock()
+		if len(p.conns) >= p.MaxTCPConnections {
+			p.mu.Unlock()
+			level.Warn(p.logger).Log("msg", "too_many_tcp_connections", "remote", conn.RemoteAddr(), "max", p.MaxTCPConnections)
+			_ = conn.Close()
+			continue
+		}
+		p.conns[conn] = struct{}{}
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go p.readTCP(conn)
+	}
+}
+
+func (p *Collector) readTCP(conn net.Conn) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		_ = conn.Close()
+		p.wg.Done()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxPacketSize)
+	for scanner.Scan() {
+		p.handleLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && !p.stopped() {
+		level.Debug(p.logger).Log("msg", "read_tcp_failed", "remote", conn.RemoteAddr(), "error", err)
+	}
+}
+
+func (p *Collector) handleLine(line string) {
+	samples, err := parseLine(line)
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "parse_line_failed", "error", err)
+		p.mu.Lock()
+		p.parseErrors++
+		p.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	for _, s := range samples {
+		name, labels, ok := p.mapper.mapName(s.name, s.typ)
+		if !ok || name == "" {
+			continue
+		}
+		p.add(now, s, name, p.labels(s.tags, labels))
+	}
+}
+
+// labels returns the sorted labels, the tags of the input are overridden by the tags
+// of dogstatsd, which are overridden by the labels of the mapping
+func (p *Collector) labels(tags, mapped map[string]string) []*dto.LabelPair {
+	merged := make(map[string]string, len(p.Tags)+len(tags)+len(mapped))
+	for _, m := range []map[string]string{p.Tags, tags, mapped} {
+		for k, v := range m {
+			k = invalidLabelCharRE.ReplaceAllString(k, "_")
+			if k == "" || strings.HasPrefix(k, "__") {
+				continue
+			}
+			merged[k] = v
+		}
+	}
+
+	labels := make([]*dto.LabelPair, 0, len(merged))
+	for k, v := range merged {
+		name, value := k, v
+		labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels
+}
+
+func (p *Collector) metricType(typ metricType) dto.MetricType {
+	switch typ {
+	case typeCounter:
+		return dto.MetricType_COUNTER
+	case typeGauge, typeSet:
+		return dto.MetricType_GAUGE
+	default:
+		if p.ObserverType == observerHistogram {
+			return dto.MetricType_HISTOGRAM
+		}
+		return dto.MetricType_SUMMARY
+	}
+}
+
+func (p *Collector) add(now time.Time, s *sample, name string, labels []*dto.LabelPair) {
+	typ := p.metricType(s.typ)
+
+	var key strings.Builder
+	key.WriteString(name)
+	for _, label := range labels {
+		key.WriteString("\xff" + label.GetName() + "\xff" + label.GetValue())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.types[name]; ok && t != typ {
+		level.Debug(p.logger).Log("msg", "metric_type_conflicts", "metric", name, "type", typ, "registered", t)
+		p.parseErrors++
+		return
+	}
+	p.types[name] = typ
+
+	ser, ok := p.series[key.String()]
+	if !ok {
+		ser = &series{name: name, labels: labels, typ: typ}
+		if typ == dto.MetricType_HISTOGRAM {
+			ser.buckets = make([]uint64, len(p.Buckets))
+		}
+		p.series[key.String()] = ser
+	}
+	ser.updated = now
+
+	switch s.typ {
+	case typeCounter:
+		ser.value += s.value / s.rate
+	case typeGauge:
+		if s.relative {
+			ser.value += s.value
+		} else {
+			ser.value = s.value
+		}
+	case typeSet:
+		if ser.set == nil {
+			ser.set = make(map[string]struct{})
+		}
+		ser.set[s.setValue] = struct{}{}
+	default:
+		value := s.value
+		if s.typ == typeTimer {
+			value /= 1000
+		}
+		// a sample with the rate is observed once weighted by 1/rate, the rate is at least
+		// minSampleRate, so the weight is bounded
+		weight := uint64(math.Round(1 / s.rate))
+		if weight < 1 {
+			weight = 1
+		}
+		ser.observe(value, weight, p.Buckets, p.MaxSamples)
+	}
+}
+
+// observe adds the value weight times to the count, the sum and the buckets, the value is
+// kept once in the samples of the quantiles, which keep at most maxSamples of the observations
+// of the interval by reservoir sampling
+func (p *series) observe(value float64, weight uint64, buckets []float64, maxSamples int) {
+	p.count += weight
+	p.sum += value * float64(weight)
+	if p.typ == dto.MetricType_HISTOGRAM {
+		for i, bound := range buckets {
+			if value <= bound {
+				p.buckets[i] += weight
+			}
+		}
+		return
+	}
+	p.observed++
+	if len(p.samples) < maxSamples {
+		p.samples = append(p.samples, value)
+		return
+	}
+	if i := rand.Int63n(p.observed); i < int64(maxSamples) {
+		p.samples[i] = value
+	}
+}
+
+// Gather returns the aggregation of the flush interval, the samples of the summaries and
+// the sets are reset
+func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		mfs = make(map[string]*dto.MetricFamily)
+		now = time.Now()
+	)
+	keys := make([]string, 0, len(p.series))
+	for key, ser := range p.series {
+		if p.TTL > 0 && now.Sub(ser.updated) > time.Duration(p.TTL) {
+			delete(p.series, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ser := p.series[key]
+		mf, ok := mfs[ser.name]
+		if !ok {
+			name, typ := ser.name, ser.typ
+			mf = &dto.MetricFamily{Name: &name, Type: &typ}
+			mfs[name] = mf
+		}
+		mf.Metric = append(mf.Metric, p.flush(ser))
+	}
+
+	// the types of the deleted series are deleted
+	for name := range p.types {
+		if _, ok := mfs[name]; !ok {
+			delete(p.types, name)
+		}
+	}
+
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]*dto.MetricFamily, 0, len(names)+1)
+	for _, name := range names {
+		metrics = append(metrics, mfs[name])
+	}
+
+	parseErrors, typ := p.parseErrors, dto.MetricType_COUNTER
+	metrics = append(metrics, &dto.MetricFamily{
+		Name:   &metricParseErrorsName,
+		Type:   &typ,
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: &parseErrors}}},
+	})
+	return metrics, nil
+}
+
+// flush returns the metric of the series and resets the samples of the interval
+func (p *Collector) flush(ser *series) *dto.Metric {
+	metric := &dto.Metric{Label: append([]*dto.LabelPair(nil), ser.labels...)}
+
+	switch ser.typ {
+	case dto.MetricType_COUNTER:
+		value := ser.value
+		metric.Counter = &dto.Counter{Value: &value}
+	case dto.MetricType_GAUGE:
+		value := ser.value
+		if ser.set != nil {
+			value = float64(len(ser.set))
+			ser.set = make(map[string]struct{})
+		}
+		metric.Gauge = &dto.Gauge{Value: &value}
+	case dto.MetricType_HISTOGRAM:
+		count, sum := ser.count, ser.sum
+		histogram := &dto.Histogram{SampleCount: &count, SampleSum: &sum}
+		for i, bound := range p.Buckets {
+			upperBound, cumulativeCount := bound, ser.buckets[i]
+			histogram.Bucket = append(histogram.Bucket, &dto.Bucket{UpperBound: &upperBound, CumulativeCount: &cumulativeCount})
+		}
+		metric.Histogram = histogram
+	case dto.MetricType_SUMMARY:
+		count, sum := ser.count, ser.sum
+		summary := &dto.Summary{SampleCount: &count, SampleSum: &sum}
+		sort.Float64s(ser.samples)
+		for _, percentile := range p.Percentiles {
+			quantile, value := percentile/100, percentileValue(ser.samples, percentile)
+			summary.Quantile = append(summary.Quantile, &dto.Quantile{Quantile: &quantile, Value: &value})
+		}
+		ser.samples, ser.observed = ser.samples[:0], 0
+		metric.Summary = summary
+	}
+	return metric
+}
+
+// percentileValue returns the nearest rank percentile of the sorted samples, NaN if no sample
+func percentileValue(sorted []float64, percentile float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+func init() {
+	inputs.RegisterFactory("statsd", func(opts ...plugins.Option) (_ plugins.InputMetricsCollector, err error) {
+
+		options := &plugins.Options{}
+		for _, o := range opts {
+			o(options)
+		}
+
+		p := &Collector{
+			logger: options.Logger,
+			series: make(map[string]*series),
+			types:  make(map[string]dto.MetricType),
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		if p.Protocol == "" {
+			p.Protocol = protocolUDP
+		}
+		switch p.Protocol {
+		case protocolUDP, protocolTCP:
+			if p.ServiceAddress == "" {
+				p.ServiceAddress = defaultServiceAddress
+			}
+		case protocolUnixgram:
+			if p.ServiceAddress == "" {
+				return nil, fmt.Errorf("service_address of statsd is required by unixgram")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported statsd protocol: %s", p.Protocol)
+		}
+		if p.MaxTCPConnections <= 0 {
+			p.MaxTCPConnections = defaultMaxTCPConnections
+		}
+
+		switch p.ObserverType {
+		case "":
+			p.ObserverType = observerSummary
+		case observerSummary, observerHistogram:
+		default:
+			return nil, fmt.Errorf("unsupported statsd observer_type: %s", p.ObserverType)
+		}
+		if len(p.Percentiles) == 0 {
+			p.Percentiles = defaultPercentiles
+		}
+		for _, percentile := range p.Percentiles {
+			if percentile <= 0 || percentile > 100 {
+				return nil, fmt.Errorf("invalid statsd percentile: %v", percentile)
+			}
+		}
+		if p.MaxSamples <= 0 {
+			p.MaxSamples = defaultMaxSamples
+		}
+		if len(p.Buckets) == 0 {
+			p.Buckets = prometheus.DefBuckets
+		}
+		if !sort.Float64sAreSorted(p.Buckets) {
+			return nil, fmt.Errorf("statsd buckets are not sorted")
+		}
+
+		p.mapper, err = newMapper(p.Mappings)
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
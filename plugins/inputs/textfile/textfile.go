@@ -0,0 +1,292 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package textfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/parsers"
+	"trellis.tech/kolekti/prome_exporters/parsers/prometheus"
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/inputs"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/config"
+)
+
+const (
+	defaultPattern = "*.prom"
+	// maxReadAttempts is the times to read a file which is modified while reading
+	maxReadAttempts = 3
+)
+
+var (
+	metricMtimeName       = "textfile_mtime_seconds"
+	metricParseErrorName  = "textfile_parse_error"
+	metricScrapeErrorName = "textfile_scrape_error"
+
+	labelFile = "file"
+)
+
+type Collector struct {
+	logger log.Logger
+	parser parsers.Parser
+
+	// Paths are the directories or the glob patterns of the files, the files matched
+	// "*.prom" are read in a directory
+	Paths []string `yaml:"paths" json:"paths"`
+
+	Tags map[string]string `yaml:"tags" json:"tags"`
+}
+
+// SampleConfig returns the sample config
+func (*Collector) SampleConfig() string {
+	return ``
+}
+
+// Description returns the description
+func (*Collector) Description() string {
+	return `Reads the metrics of the prometheus text format from the files, as the textfile collector of node_exporter`
+}
+
+// Gather reads all the files matched the paths
+func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
+	files, err := p.files()
+	if err != nil {
+		level.Error(p.logger).Log("msg", "glob_files_failed", "error", err)
+	}
+
+	var (
+		mfs         = make(map[string]*dto.MetricFamily)
+		mtime       = newGauge(metricMtimeName, "Unixtime mtime of textfiles successfully read.")
+		parseError  = newGauge(metricParseErrorName, "1 if the textfile failed to be read or parsed, 0 otherwise.")
+		scrapeError = newGauge(metricScrapeErrorName, "1 if there was an error opening or reading a file, 0 otherwise.")
+
+		scrapeErrorValue float64
+	)
+	if err != nil {
+		scrapeErrorValue = 1
+	}
+
+	for _, file := range files {
+		modTime, err := p.gatherFile(file, mfs)
+		if err != nil {
+			level.Error(p.logger).Log("msg", "read_textfile_failed", "file", file, "error", err)
+			scrapeErrorValue = 1
+			addGauge(parseError, 1, file)
+			continue
+		}
+		addGauge(parseError, 0, file)
+		addGauge(mtime, float64(modTime.UnixNano())/1e9, file)
+	}
+	addGauge(scrapeError, scrapeErrorValue, "")
+
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]*dto.MetricFamily, 0, len(names)+3)
+	for _, name := range names {
+		metrics = append(metrics, mfs[name])
+	}
+	for _, mf := range []*dto.MetricFamily{mtime, parseError, scrapeError} {
+		if len(mf.GetMetric()) > 0 {
+			metrics = append(metrics, mf)
+		}
+	}
+	return metrics, nil
+}
+
+// files returns the sorted files matched the paths, a file matched by several paths is returned once
+func (p *Collector) files() ([]string, error) {
+	var (
+		files []string
+		seen  = make(map[string]bool)
+		errs  []string
+	)
+	for _, path := range p.Paths {
+		pattern := path
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			pattern = filepath.Join(path, defaultPattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, match := range matches {
+			// hidden files are the temporary files of the writers
+			if seen[match] || strings.HasPrefix(filepath.Base(match), ".") {
+				continue
+			}
+			if fi, err := os.Stat(match); err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			seen[match] = true
+			files = append(files, match)
+		}
+	}
+	sort.Strings(files)
+
+	if len(errs) > 0 {
+		return files, fmt.Errorf("invalid paths: %s", strings.Join(errs, "; "))
+	}
+	return files, nil
+}
+
+func (p *Collector) gatherFile(file string, mfs map[string]*dto.MetricFamily) (time.Time, error) {
+	bs, modTime, err := readFile(file)
+	if err != nil {
+		return modTime, err
+	}
+
+	tags := make(map[string]string)
+	if p.Tags != nil {
+		tags = config.DeepCopy(p.Tags).(map[string]string)
+	}
+	tags[labelFile] = file
+
+	fileMfs, err := p.parser.Parse(bs, tags, "")
+	if err != nil {
+		return modTime, err
+	}
+
+	// check all the families before merging, a file is merged entirely or not at all
+	for name, family := range fileMfs {
+		for _, metric := range family.GetMetric() {
+			if metric.TimestampMs != nil {
+				return modTime, fmt.Errorf("metric %s has a timestamp, which is not supported", name)
+			}
+		}
+		if mf, ok := mfs[name]; ok && mf.GetType() != family.GetType() {
+			return modTime, fmt.Errorf("metric %s has the type %s, but %s in another file", name, family.GetType(), mf.GetType())
+		}
+	}
+	for name, family := range fileMfs {
+		mf, ok := mfs[name]
+		if !ok {
+			mfs[name] = family
+			continue
+		}
+		mf.Metric = append(mf.Metric, family.GetMetric()...)
+	}
+	return modTime, nil
+}
+
+// readFile reads the content of the file, it is read again if the file is modified while
+// reading, so a file written in place is not read half-written. A file which is replaced
+// by an atomic rename is read from the opened one.
+func readFile(file string) ([]byte, time.Time, error) {
+	for i := 0; ; i++ {
+		bs, modTime, changed, err := readFileOnce(file)
+		if err != nil || !changed {
+			return bs, modTime, err
+		}
+		if i+1 >= maxReadAttempts {
+			return nil, modTime, fmt.Errorf("file is modified while reading")
+		}
+	}
+}
+
+func readFileOnce(file string) (_ []byte, _ time.Time, changed bool, _ error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer f.Close()
+
+	before, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		return nil, before.ModTime(), false, err
+	}
+
+	after, err := f.Stat()
+	if err != nil {
+		return nil, before.ModTime(), false, err
+	}
+
+	changed = int64(len(bs)) != after.Size() ||
+		before.Size() != after.Size() ||
+		!before.ModTime().Equal(after.ModTime())
+	return bs, after.ModTime(), changed, nil
+}
+
+func newGauge(name, help string) *dto.MetricFamily {
+	typ := dto.MetricType_GAUGE
+	return &dto.MetricFamily{
+		Name: &name,
+		Help: &help,
+		Type: &typ,
+	}
+}
+
+func addGauge(mf *dto.MetricFamily, value float64, file string) {
+	metric := &dto.Metric{Gauge: &dto.Gauge{Value: &value}}
+	if file != "" {
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: &labelFile, Value: &file})
+	}
+	mf.Metric = append(mf.Metric, metric)
+}
+
+func init() {
+	inputs.RegisterFactory("textfile", func(opts ...plugins.Option) (_ plugins.InputMetricsCollector, err error) {
+
+		options := &plugins.Options{}
+		for _, o := range opts {
+			o(options)
+		}
+
+		p := &Collector{
+			logger: options.Logger,
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(p.Paths) == 0 {
+			return nil, fmt.Errorf("paths of textfile are required")
+		}
+		for _, path := range p.Paths {
+			if _, err := filepath.Match(path, ""); err != nil {
+				return nil, fmt.Errorf("invalid textfile path %s: %v", path, err)
+			}
+		}
+
+		p.parser, err = prometheus.NewParser(log.With(p.logger, "parser", "prometheus"), parsers.Config{Name: "prometheus"})
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
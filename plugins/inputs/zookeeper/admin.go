@@ -0,0 +1,151 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package zookeeper
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"trellis.tech/kolekti/prome_exporters/internal"
+
+	"trellis.tech/trellis/common.v1/builder"
+)
+
+// the commands of the admin server, which is served by zookeeper 3.5+ on 8080
+const (
+	adminMonitor     = "monitor"
+	adminConnections = "connections"
+
+	maxErrMsgLen int64 = 1024
+)
+
+// adminCommands are the four letter words supported by the admin server
+var adminCommands = map[string]string{
+	cmdMntr: adminMonitor,
+	cmdCons: adminConnections,
+}
+
+type adminConnectionsResponse struct {
+	Connections       []*adminConnection `json:"connections"`
+	SecureConnections []*adminConnection `json:"secure_connections"`
+}
+
+type adminConnection struct {
+	RemoteSocketAddress string   `json:"remote_socket_address"`
+	SessionID           string   `json:"session_id"`
+	OutstandingRequests float64  `json:"outstanding_requests"`
+	PacketsReceived     float64  `json:"packets_received"`
+	PacketsSent         float64  `json:"packets_sent"`
+	SessionTimeout      *float64 `json:"session_timeout"`
+	MinLatency          *float64 `json:"min_latency"`
+	AvgLatency          *float64 `json:"avg_latency"`
+	MaxLatency          *float64 `json:"max_latency"`
+}
+
+// adminCommand gets "<address>/commands/<command>" and decodes the json response
+func (p *Collector) adminCommand(ctx context.Context, address, command string, v interface{}) error {
+	u := strings.TrimSuffix(address, "/") + "/commands/" + command
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", builder.Version())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer internal.IOClose(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorLine := ""
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
+		if scanner.Scan() {
+			errorLine = scanner.Text()
+		}
+		return fmt.Errorf("when reading [%s] received status code: %d. body: %s", u, resp.StatusCode, errorLine)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *Collector) gatherAdmin(ctx context.Context, server *Server, s *serverMetrics) error {
+	for _, cmd := range server.Commands {
+		command := adminCommands[cmd]
+		switch command {
+		case adminMonitor:
+			monitor := make(map[string]interface{})
+			if err := p.adminCommand(ctx, server.Address, command, &monitor); err != nil {
+				return fmt.Errorf("%s: %v", command, err)
+			}
+			if errMsg, ok := monitor["error"].(string); ok && errMsg != "" {
+				return fmt.Errorf("%s: %s", command, errMsg)
+			}
+			s.parseMonitor(monitor)
+		case adminConnections:
+			connections := &adminConnectionsResponse{}
+			if err := p.adminCommand(ctx, server.Address, command, connections); err != nil {
+				return fmt.Errorf("%s: %v", command, err)
+			}
+			for _, conn := range append(connections.Connections, connections.SecureConnections...) {
+				s.addConnection(&connection{
+					client:     strings.TrimPrefix(conn.RemoteSocketAddress, "/"),
+					sessionID:  conn.SessionID,
+					queued:     conn.OutstandingRequests,
+					received:   conn.PacketsReceived,
+					sent:       conn.PacketsSent,
+					timeout:    conn.SessionTimeout,
+					minLatency: conn.MinLatency,
+					avgLatency: conn.AvgLatency,
+					maxLatency: conn.MaxLatency,
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// parseMonitor adds the keys of the monitor command as the ones of mntr, "zk_" is prefixed
+func (p *serverMetrics) parseMonitor(monitor map[string]interface{}) {
+	for key, value := range monitor {
+		if key == "command" || key == "error" {
+			continue
+		}
+
+		var str string
+		switch v := value.(type) {
+		case string:
+			str = v
+		case float64:
+			str = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			str = "0"
+			if v {
+				str = "1"
+			}
+		default:
+			continue
+		}
+
+		p.addMntr("zk_"+key, str)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package zookeeper
+
+import (
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	stateLeader   = "leader"
+	stateFollower = "follower"
+	stateObserver = "observer"
+)
+
+// ensemble returns the metrics derived from the servers of the cluster:
+//
+//	zookeeper_ensemble_servers: the configured servers
+//	zookeeper_ensemble_servers_up: the servers gathered
+//	zookeeper_ensemble_leaders: the leaders, which should be 1
+//	zookeeper_ensemble_followers, zookeeper_ensemble_observers
+//	zookeeper_ensemble_quorum_size: the majority of the voting servers, the observers are not voting
+//	zookeeper_ensemble_quorum_healthy: 1 if there is exactly one leader and the voting servers up reach the quorum
+//	zookeeper_ensemble_max_zxid_lag: the max zxid lag of the followers and the observers behind the leader, needs srvr,
+//	    it is not reported if any of them is in another epoch
+//	zookeeper_ensemble_synced_followers: zk_synced_followers of the leader, needs mntr
+//	zookeeper_ensemble_expected_followers: the voting servers except the leader
+func (p *Collector) ensemble(cluster string, servers []*serverMetrics) *serverMetrics {
+	var (
+		up, leaders, followers, observers int
+		leader                            *serverMetrics
+	)
+	for _, s := range servers {
+		if s.err != nil {
+			continue
+		}
+		up++
+		switch s.state {
+		case stateLeader:
+			leaders++
+			leader = s
+		case stateFollower:
+			followers++
+		case stateObserver:
+			observers++
+		}
+	}
+
+	// the servers down are counted as voting ones, as their roles are unknown
+	voting := len(servers) - observers
+	quorum := voting/2 + 1
+
+	var healthy float64
+	if leaders == 1 && leaders+followers >= quorum {
+		healthy = 1
+	}
+
+	labels := []string{labelCluster, cluster}
+	for k, v := range p.Tags {
+		labels = append(labels, k, v)
+	}
+
+	e := newServerMetrics()
+	e.add(metricPrefix+"ensemble_servers", dto.MetricType_GAUGE, float64(len(servers)), labels...)
+	e.add(metricPrefix+"ensemble_servers_up", dto.MetricType_GAUGE, float64(up), labels...)
+	e.add(metricPrefix+"ensemble_leaders", dto.MetricType_GAUGE, float64(leaders), labels...)
+	e.add(metricPrefix+"ensemble_followers", dto.MetricType_GAUGE, float64(followers), labels...)
+	e.add(metricPrefix+"ensemble_observers", dto.MetricType_GAUGE, float64(observers), labels...)
+	e.add(metricPrefix+"ensemble_quorum_size", dto.MetricType_GAUGE, float64(quorum), labels...)
+	e.add(metricPrefix+"ensemble_quorum_healthy", dto.MetricType_GAUGE, healthy, labels...)
+	e.add(metricPrefix+"ensemble_expected_followers", dto.MetricType_GAUGE, float64(voting-1), labels...)
+
+	if leaders != 1 {
+		return e
+	}
+
+	if leader.syncedFollowers != nil {
+		e.add(metricPrefix+"ensemble_synced_followers", dto.MetricType_GAUGE, *leader.syncedFollowers, labels...)
+	}
+
+	// the lower 32 bits of a zxid are the counter of the epoch in the higher 32 bits, the lag of a
+	// server in another epoch, such as one not synced after an election, is unknown
+	if leader.zxid != nil {
+		var (
+			maxLag float64
+			known  bool
+			epoch  = *leader.zxid >> 32
+		)
+		for _, s := range servers {
+			if s.err != nil || s == leader || s.zxid == nil {
+				continue
+			}
+			if s.state != stateFollower && s.state != stateObserver {
+				continue
+			}
+			if *s.zxid>>32 != epoch {
+				known = false
+				break
+			}
+			known = true
+			counter, leaderCounter := uint32(*s.zxid), uint32(*leader.zxid)
+			if leaderCounter > counter {
+				if lag := float64(leaderCounter - counter); lag > maxLag {
+					maxLag = lag
+				}
+			}
+		}
+		if known {
+			e.add(metricPrefix+"ensemble_max_zxid_lag", dto.MetricType_GAUGE, maxLag, labels...)
+		}
+	}
+	return e
+}
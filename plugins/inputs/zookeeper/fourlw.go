@@ -0,0 +1,317 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package zookeeper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// the four letter words
+const (
+	cmdMntr = "mntr"
+	cmdSrvr = "srvr"
+	cmdCons = "cons"
+	cmdWchs = "wchs"
+	cmdWchc = "wchc"
+	cmdEnvi = "envi"
+	cmdRuok = "ruok"
+)
+
+var (
+	consRE = regexp.MustCompile(`^\s*/?(\S+?)\[\d+\]\((.*)\)\s*$`)
+	wchsRE = regexp.MustCompile(`^(\d+) connections watching (\d+) paths`)
+
+	envLabels = map[string]string{
+		"zookeeper.version": "zookeeper_version",
+		"java.version":      "java_version",
+		"java.vendor":       "java_vendor",
+		"os.name":           "os_name",
+		"os.arch":           "os_arch",
+		"os.version":        "os_version",
+	}
+)
+
+// fourLetterWord sends the command and returns the response, the server closes the
+// connection after the response
+func (p *Collector) fourLetterWord(ctx context.Context, address, cmd string) ([]byte, error) {
+	c, err := p.dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// Apply deadline to connection
+	deadline, ok := ctx.Deadline()
+	if ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := fmt.Fprintf(c, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	bs, err := io.ReadAll(c)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(bs, []byte("is not executed because it is not in the whitelist")) {
+		return nil, fmt.Errorf("%s is not in the whitelist of %s", cmd, address)
+	}
+	return bs, nil
+}
+
+func (p *Collector) gather4lw(ctx context.Context, server *Server, s *serverMetrics) error {
+	for _, cmd := range server.Commands {
+		bs, err := p.fourLetterWord(ctx, server.Address, cmd)
+		if err != nil {
+			if cmd == cmdRuok {
+				s.add(metricPrefix+"ruok", dto.MetricType_GAUGE, 0)
+				continue
+			}
+			return fmt.Errorf("%s: %v", cmd, err)
+		}
+
+		switch cmd {
+		case cmdMntr:
+			s.parseMntr(bs, p.logger)
+		case cmdSrvr:
+			err = s.parseSrvr(bs)
+		case cmdCons:
+			s.parseCons(bs)
+		case cmdWchs:
+			err = s.parseWchs(bs)
+		case cmdWchc:
+			s.parseWchc(bs)
+		case cmdEnvi:
+			s.parseEnvi(bs)
+		case cmdRuok:
+			var value float64
+			if strings.TrimSpace(string(bs)) == "imok" {
+				value = 1
+			}
+			s.add(metricPrefix+"ruok", dto.MetricType_GAUGE, value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", cmd, err)
+		}
+	}
+	return nil
+}
+
+// parseSrvr parses the lines as "Latency min/avg/max: 0/0.1/3", "Zxid: 0x100000002", "Mode: leader"
+func (p *serverMetrics) parseSrvr(bs []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "Zookeeper version":
+			version := strings.SplitN(value, ",", 2)[0]
+			p.add(metricPrefix+"srvr_version", dto.MetricType_GAUGE, 1, "version", version)
+		case "Latency min/avg/max":
+			values := strings.Split(value, "/")
+			if len(values) != 3 {
+				return fmt.Errorf("unexpected latency: %q", value)
+			}
+			for i, name := range []string{"min", "avg", "max"} {
+				if v, err := strconv.ParseFloat(values[i], 64); err == nil {
+					p.add(metricPrefix+"srvr_latency_"+name, dto.MetricType_GAUGE, v)
+				}
+			}
+		case "Zxid":
+			zxid, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected zxid: %q", value)
+			}
+			p.zxid = &zxid
+			p.add(metricPrefix+"srvr_zxid", dto.MetricType_GAUGE, float64(zxid))
+		case "Mode":
+			if p.state == "" {
+				p.state = value
+			}
+			p.add(metricPrefix+"srvr_mode", dto.MetricType_GAUGE, 1, "mode", value)
+		case "Received", "Sent":
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				p.add(metricPrefix+"srvr_"+strings.ToLower(key)+"_total", dto.MetricType_COUNTER, v)
+			}
+		case "Connections", "Outstanding", "Node count":
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				p.add(metricPrefix+"srvr_"+strings.ReplaceAll(strings.ToLower(key), " ", "_"), dto.MetricType_GAUGE, v)
+			}
+		}
+	}
+	return nil
+}
+
+// connection is a client connection of cons or the connections command of the admin server
+type connection struct {
+	client     string
+	sessionID  string
+	queued     float64
+	received   float64
+	sent       float64
+	timeout    *float64
+	minLatency *float64
+	avgLatency *float64
+	maxLatency *float64
+}
+
+// parseCons parses the lines as
+// " /127.0.0.1:54860[1](queued=0,recved=1,sent=1,sid=0x1000,lop=SESS,est=1,to=30000,lcxid=0x0,lzxid=0x1,lresp=1,llat=0,minlat=0,avglat=0,maxlat=0)"
+func (p *serverMetrics) parseCons(bs []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		parts := consRE.FindStringSubmatch(scanner.Text())
+		if len(parts) != 3 {
+			continue
+		}
+
+		conn := &connection{client: parts[1]}
+		for _, field := range strings.Split(parts[2], ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if kv[0] == "sid" {
+				conn.sessionID = kv[1]
+				continue
+			}
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "queued":
+				conn.queued = v
+			case "recved":
+				conn.received = v
+			case "sent":
+				conn.sent = v
+			case "to":
+				conn.timeout = &v
+			case "minlat":
+				conn.minLatency = &v
+			case "avglat":
+				conn.avgLatency = &v
+			case "maxlat":
+				conn.maxLatency = &v
+			}
+		}
+		p.addConnection(conn)
+	}
+}
+
+func (p *serverMetrics) addConnection(conn *connection) {
+	labels := []string{"client", conn.client, "session_id", conn.sessionID}
+	p.add(metricPrefix+"connection_queued", dto.MetricType_GAUGE, conn.queued, labels...)
+	p.add(metricPrefix+"connection_received_total", dto.MetricType_COUNTER, conn.received, labels...)
+	p.add(metricPrefix+"connection_sent_total", dto.MetricType_COUNTER, conn.sent, labels...)
+	for name, value := range map[string]*float64{
+		"connection_session_timeout_ms": conn.timeout,
+		"connection_min_latency":        conn.minLatency,
+		"connection_avg_latency":        conn.avgLatency,
+		"connection_max_latency":        conn.maxLatency,
+	} {
+		if value != nil {
+			p.add(metricPrefix+name, dto.MetricType_GAUGE, *value, labels...)
+		}
+	}
+}
+
+// parseWchs parses "1 connections watching 2 paths" and "Total watches:3"
+func (p *serverMetrics) parseWchs(bs []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if parts := wchsRE.FindStringSubmatch(line); len(parts) == 3 {
+			connections, _ := strconv.ParseFloat(parts[1], 64)
+			paths, _ := strconv.ParseFloat(parts[2], 64)
+			p.add(metricPrefix+"watch_connections", dto.MetricType_GAUGE, connections)
+			p.add(metricPrefix+"watch_paths", dto.MetricType_GAUGE, paths)
+		} else if strings.HasPrefix(line, "Total watches:") {
+			watches, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(line, "Total watches:")), 64)
+			if err != nil {
+				return fmt.Errorf("unexpected line in wchs response: %q", line)
+			}
+			p.add(metricPrefix+"watches", dto.MetricType_GAUGE, watches)
+		}
+	}
+	return nil
+}
+
+// parseWchc parses the sessions and their watched paths, the paths are indented
+//
+//	0x10000c1e3400000
+//		/foo
+//		/bar
+func (p *serverMetrics) parseWchc(bs []byte) {
+	var (
+		sessions []string
+		watches  = make(map[string]float64)
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "0x") {
+			sessions = append(sessions, strings.TrimSpace(line))
+			continue
+		}
+		if len(sessions) > 0 {
+			watches[sessions[len(sessions)-1]]++
+		}
+	}
+	for _, session := range sessions {
+		p.add(metricPrefix+"session_watches", dto.MetricType_GAUGE, watches[session], "session_id", session)
+	}
+}
+
+// parseEnvi parses the lines as "java.version=11.0.11" to the labels of zookeeper_env_info
+func (p *serverMetrics) parseEnvi(bs []byte) {
+	var labels []string
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		label, ok := envLabels[strings.TrimSpace(kv[0])]
+		if !ok {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		if label == "zookeeper_version" {
+			value = strings.SplitN(value, ",", 2)[0]
+		}
+		labels = append(labels, label, value)
+	}
+	p.add(metricPrefix+"env_info", dto.MetricType_GAUGE, 1, labels...)
+}
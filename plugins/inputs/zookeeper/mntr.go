@@ -0,0 +1,218 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package zookeeper
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	mntrServerState = "zk_server_state"
+	mntrVersion     = "zk_version"
+
+	labelServerState = "server_state"
+	labelVersion     = "version"
+	labelValue       = "value"
+
+	// summarySuffix is appended to a summary of the same name as a gauge
+	summarySuffix = "_summary"
+)
+
+var (
+	mntrKeyRE = regexp.MustCompile(`^zk_\w+$`)
+	// the percentiles of the summaries are "zk_p99_<name>" or "zk_<name>_p99"
+	mntrQuantileRE = regexp.MustCompile(`^zk_(?:p(50|95|99|999)_(\w+)|(\w+)_p(50|95|99|999))$`)
+	// the count and sum of the summaries are "zk_cnt_<name>" and "zk_sum_<name>"
+	mntrSummaryRE = regexp.MustCompile(`^zk_(cnt|sum)_(\w+)$`)
+
+	// mntrStates are the states of zk_server_state, a state not in them is added
+	mntrStates = []string{"leader", "follower", "observer", "standalone", "read-only"}
+
+	// mntrCounters are the keys of the counters, the others are gauges
+	mntrCounters = map[string]bool{
+		"zk_packets_received":                          true,
+		"zk_packets_sent":                              true,
+		"zk_bytes_received_count":                      true,
+		"zk_commit_count":                              true,
+		"zk_connection_drop_count":                     true,
+		"zk_connection_rejected":                       true,
+		"zk_connection_request_count":                  true,
+		"zk_connection_revalidate_count":               true,
+		"zk_dead_watchers_cleared":                     true,
+		"zk_dead_watchers_queued":                      true,
+		"zk_diff_count":                                true,
+		"zk_digest_mismatches_count":                   true,
+		"zk_ensemble_auth_fail":                        true,
+		"zk_ensemble_auth_skip":                        true,
+		"zk_ensemble_auth_success":                     true,
+		"zk_learner_commit_received_count":             true,
+		"zk_learner_proposal_received_count":           true,
+		"zk_looking_count":                             true,
+		"zk_outstanding_changes_removed":               true,
+		"zk_prep_processor_request_queued":             true,
+		"zk_proposal_count":                            true,
+		"zk_quit_leading_due_to_disloyal_voter":        true,
+		"zk_request_commit_queued":                     true,
+		"zk_request_throttle_wait_count":               true,
+		"zk_response_packet_cache_hits":                true,
+		"zk_response_packet_cache_misses":              true,
+		"zk_response_packet_get_children_cache_hits":   true,
+		"zk_response_packet_get_children_cache_misses": true,
+		"zk_revalidate_count":                          true,
+		"zk_sessionless_connections_expired":           true,
+		"zk_snap_count":                                true,
+		"zk_stale_replies":                             true,
+		"zk_stale_requests":                            true,
+		"zk_stale_requests_dropped":                    true,
+		"zk_stale_sessions_expired":                    true,
+		"zk_sync_processor_request_queued":             true,
+		"zk_tls_handshake_exceeded":                    true,
+		"zk_unrecoverable_error_count":                 true,
+		"zk_unsuccessful_handshake":                    true,
+	}
+)
+
+// parseMntr parses the lines of "<key>\t<value>", the unknown lines are skipped
+func (p *serverMetrics) parseMntr(bs []byte, logger log.Logger) {
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		key := fields[0]
+		if len(fields) < 2 || !mntrKeyRE.MatchString(key) {
+			level.Debug(logger).Log("msg", "skip_mntr_line", "line", line)
+			continue
+		}
+		p.addMntr(key, strings.TrimSpace(strings.TrimPrefix(line, key)))
+	}
+}
+
+// addMntr adds a key of mntr or the monitor command of the admin server:
+//
+//	zk_server_state: the state-set zookeeper_zk_server_state{server_state="<state>"}
+//	zk_version: zookeeper_zk_version{version="<version>"} 1
+//	zk_p99_<name>, zk_<name>_p99, zk_cnt_<name>, zk_sum_<name>: the summary zookeeper_zk_<name>,
+//	or zookeeper_zk_<name>_summary if zk_<name> is a gauge too
+//	the numeric keys: the counters of mntrCounters or the gauges
+//	the others: zookeeper_<key>_info{value="<value>"} 1
+func (p *serverMetrics) addMntr(key, value string) {
+	metricName := metricPrefix + key
+
+	switch key {
+	case mntrServerState:
+		p.state = value
+		states := mntrStates
+		if !containsString(states, value) {
+			states = append(append([]string{}, states...), value)
+		}
+		for _, state := range states {
+			var v float64
+			if state == value {
+				v = 1
+			}
+			p.add(metricName, dto.MetricType_GAUGE, v, labelServerState, state)
+		}
+		return
+	case mntrVersion:
+		p.add(metricName, dto.MetricType_GAUGE, 1, labelVersion, strings.SplitN(value, ",", 2)[0])
+		return
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		p.add(metricName+"_info", dto.MetricType_GAUGE, 1, labelValue, value)
+		return
+	}
+
+	if parts := mntrQuantileRE.FindStringSubmatch(key); len(parts) == 5 {
+		percentile, name := parts[1], parts[2]
+		if percentile == "" {
+			percentile, name = parts[4], parts[3]
+		}
+		quantile, _ := strconv.ParseFloat("0."+percentile, 64)
+		summary := p.summary(metricPrefix + "zk_" + name)
+		summary.Quantile = append(summary.Quantile, &dto.Quantile{Quantile: &quantile, Value: &v})
+		return
+	}
+	if parts := mntrSummaryRE.FindStringSubmatch(key); len(parts) == 3 {
+		summary := p.summary(metricPrefix + "zk_" + parts[2])
+		if parts[1] == "cnt" {
+			count := uint64(v)
+			summary.SampleCount = &count
+		} else {
+			summary.SampleSum = &v
+		}
+		return
+	}
+
+	typ := dto.MetricType_GAUGE
+	if mntrCounters[key] {
+		typ = dto.MetricType_COUNTER
+	}
+	// the keys of monitor are not ordered, the summary added before is renamed
+	if mf, ok := p.metrics[metricName]; ok && mf.GetType() == dto.MetricType_SUMMARY {
+		renamed := metricName + summarySuffix
+		mf.Name = &renamed
+		p.metrics[renamed] = mf
+		delete(p.metrics, metricName)
+	}
+	p.add(metricName, typ, v)
+	if key == "zk_synced_followers" {
+		p.syncedFollowers = &v
+	}
+}
+
+// summary returns the summary of the name, which is created if not exists, the summary is
+// suffixed with summarySuffix if the name is a family of another type
+func (p *serverMetrics) summary(name string) *dto.Summary {
+	mf, ok := p.metrics[name]
+	if ok && mf.GetType() != dto.MetricType_SUMMARY {
+		name += summarySuffix
+		mf, ok = p.metrics[name]
+	}
+	if ok && len(mf.GetMetric()) > 0 && mf.GetMetric()[0].Summary != nil {
+		return mf.GetMetric()[0].Summary
+	}
+
+	metricName, typ := name, dto.MetricType_SUMMARY
+	summary := &dto.Summary{}
+	p.metrics[name] = &dto.MetricFamily{
+		Name:   &metricName,
+		Type:   &typ,
+		Metric: []*dto.Metric{{Summary: summary}},
+	}
+	return summary
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
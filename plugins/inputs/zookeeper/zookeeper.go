@@ -15,34 +15,29 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package zookeeper
 
 import (
-	"bufio"
 	"context"
 	tls2 "crypto/tls"
 	"fmt"
 	"net"
-	"regexp"
-	"strconv"
-	"strings"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"trellis.tech/kolekti/prome_exporters/plugins"
 	"trellis.tech/kolekti/prome_exporters/plugins/inputs"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	dto "github.com/prometheus/client_model/go"
 	"trellis.tech/trellis/common.v1/crypto/tls"
 	"trellis.tech/trellis/common.v1/types"
 )
 
 var (
-	zookeeperFormatRE = regexp.MustCompile(`(^zk_\w+)\s+([\w\.\-]+)`)
-
 	defaultTimeout = 5 * time.Second
 
-	metricPrefix              = "zookeeper_"
-	zkServerStateName         = fmt.Sprintf("%szk_server_state", metricPrefix)
-	zkVersionName             = fmt.Sprintf("%szk_version", metricPrefix)
-	defaultValue      float64 = 1
+	metricPrefix = "zookeeper_"
 )
 
 const (
@@ -54,18 +49,100 @@ var (
 	labelState    = "state"
 	labelServer   = "server"
 	labelInstance = "instance"
+	labelCluster  = "cluster"
+
+	metricUpName             = metricPrefix + "up"
+	metricScrapeDurationName = metricPrefix + "scrape_duration_seconds"
+)
+
+const (
+	mode4lw   = "4lw"
+	modeAdmin = "admin"
+
+	default4lwPort = "2181"
 )
 
+// Server is a zookeeper server gathered by the four letter words or the admin server
+type Server struct {
+	// Address is "host:port" for 4lw, the url of the admin server for admin, eg: http://127.0.0.1:8080
+	Address string `yaml:"address" json:"address"`
+	// Mode is 4lw or admin, defaults 4lw
+	Mode string `yaml:"mode" json:"mode"`
+	// Commands are the four letter words, defaults the commands of the input, the admin
+	// server supports mntr (/commands/monitor) and cons (/commands/connections)
+	Commands []string `yaml:"commands" json:"commands"`
+	// Cluster groups the servers of an ensemble, which adds the label cluster and the ensemble metrics
+	Cluster string `yaml:"cluster" json:"cluster"`
+
+	instance, host, port string
+}
+
 type Collector struct {
 	logger    log.Logger
 	tlsConfig *tls2.Config
-
-	Servers []string       `yaml:"servers" json:"servers"`
-	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+	client    *http.Client
+
+	// Servers are gathered by the four letter words
+	Servers []string `yaml:"servers" json:"servers"`
+	// Cluster of the servers
+	Cluster string `yaml:"cluster" json:"cluster"`
+	// Endpoints are the servers with the mode of each
+	Endpoints []*Server `yaml:"endpoints" json:"endpoints"`
+	// Commands are the default four letter words of the servers: mntr, srvr, cons, wchs, wchc, envi, ruok, defaults mntr
+	Commands []string       `yaml:"commands" json:"commands"`
+	Timeout  types.Duration `yaml:"timeout" json:"timeout"`
 
 	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
 
 	Tags map[string]string `yaml:"tags" json:"tags"`
+
+	servers []*Server
+}
+
+// serverMetrics are the metrics of a server
+type serverMetrics struct {
+	metrics map[string]*dto.MetricFamily
+	// state is the zk_server_state of mntr or the mode of srvr
+	state string
+	// zxid is the zxid of srvr
+	zxid *uint64
+	// syncedFollowers is the zk_synced_followers of the leader
+	syncedFollowers *float64
+
+	err      error
+	duration time.Duration
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{metrics: make(map[string]*dto.MetricFamily)}
+}
+
+// add adds a metric with the label pairs
+func (p *serverMetrics) add(name string, typ dto.MetricType, value float64, labels ...string) {
+	mf, ok := p.metrics[name]
+	if !ok {
+		metricName, metricType := name, typ
+		mf = &dto.MetricFamily{
+			Name: &metricName,
+			Type: &metricType,
+		}
+		p.metrics[name] = mf
+	}
+
+	metric := &dto.Metric{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelName, labelValue := labels[i], labels[i+1]
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: &labelName, Value: &labelValue})
+	}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		metric.Counter = &dto.Counter{Value: &value}
+	case dto.MetricType_GAUGE:
+		metric.Gauge = &dto.Gauge{Value: &value}
+	default:
+		metric.Untyped = &dto.Untyped{Value: &value}
+	}
+	mf.Metric = append(mf.Metric, metric)
 }
 
 // SampleConfig returns sample configuration message
@@ -75,39 +152,60 @@ func (p *Collector) SampleConfig() string {
 
 // Description returns description of Zookeeper plugin
 func (p *Collector) Description() string {
-	return `Reads 'mntr' stats from one or many zookeeper servers`
+	return `Reads the four letter words or the admin server stats from one or many zookeeper servers`
 }
 
-// Gather reads stats from defaults configured servers accumulates stats
+// Gather reads stats from defaults configured servers accumulates stats, the servers
+// are gathered concurrently with the timeout of each
 func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
-	ctx := context.Background()
-
-	if p.Timeout < types.Duration(1*time.Second) {
-		p.Timeout = types.Duration(defaultTimeout)
-	}
-
-	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
-	defer cancel()
-
-	if len(p.Servers) == 0 {
-		p.Servers = []string{":2181"}
+	var (
+		results = make([]*serverMetrics, len(p.servers))
+		wg      sync.WaitGroup
+	)
+	for i, server := range p.servers {
+		wg.Add(1)
+		go func(i int, server *Server) {
+			defer wg.Done()
+			results[i] = p.gatherServer(server)
+		}(i, server)
 	}
+	wg.Wait()
+
+	var (
+		mfs      = make(map[string]*dto.MetricFamily)
+		up       = newServerMetrics()
+		clusters = make(map[string][]*serverMetrics)
+		names    []string
+	)
+	for i, s := range results {
+		server := p.servers[i]
+		if server.Cluster != "" {
+			if _, ok := clusters[server.Cluster]; !ok {
+				names = append(names, server.Cluster)
+			}
+			clusters[server.Cluster] = append(clusters[server.Cluster], s)
+		}
 
-	mfs := make(map[string]*dto.MetricFamily)
-	for _, serverAddress := range p.Servers {
-		mfsServer, err := p.gatherServer(ctx, serverAddress)
-		if err != nil {
-			continue
+		var upValue float64
+		if s.err == nil {
+			upValue = 1
+		} else {
+			level.Error(p.logger).Log("msg", "gather_server_failed", "server", server.Address, "mode", server.Mode, "error", s.err)
 		}
-		for name, family := range mfsServer {
-			mf, ok := mfs[name]
-			if !ok {
-				mfs[name] = family
-				continue
-			}
-			mf.Metric = append(mf.Metric, family.GetMetric()...)
+		labels := p.serverLabels(server)
+		up.add(metricUpName, dto.MetricType_GAUGE, upValue, labels...)
+		up.add(metricScrapeDurationName, dto.MetricType_GAUGE, s.duration.Seconds(), labels...)
+		if s.err != nil {
+			continue
 		}
+		mergeFamilies(mfs, s.metrics)
 	}
+	mergeFamilies(mfs, up.metrics)
+
+	for _, name := range names {
+		mergeFamilies(mfs, p.ensemble(name, clusters[name]).metrics)
+	}
+
 	var metrics []*dto.MetricFamily
 	for _, family := range mfs {
 		metrics = append(metrics, family)
@@ -115,6 +213,29 @@ func (p *Collector) Gather() ([]*dto.MetricFamily, error) {
 	return metrics, nil
 }
 
+func mergeFamilies(mfs, families map[string]*dto.MetricFamily) {
+	for name, family := range families {
+		mf, ok := mfs[name]
+		if !ok {
+			mfs[name] = family
+			continue
+		}
+		mf.Metric = append(mf.Metric, family.GetMetric()...)
+	}
+}
+
+// serverLabels returns the label pairs of the server without the state
+func (p *Collector) serverLabels(server *Server) []string {
+	labels := []string{labelInstance, server.instance, labelServer, server.host, labelPort, server.port}
+	if server.Cluster != "" {
+		labels = append(labels, labelCluster, server.Cluster)
+	}
+	for k, v := range p.Tags {
+		labels = append(labels, k, v)
+	}
+	return labels
+}
+
 func (p *Collector) dial(ctx context.Context, addr string) (net.Conn, error) {
 	var dialer net.Dialer
 	if p.tlsConfig != nil {
@@ -127,120 +248,86 @@ func (p *Collector) dial(ctx context.Context, addr string) (net.Conn, error) {
 	return dialer.DialContext(ctx, "tcp", addr)
 }
 
-func (p *Collector) gatherServer(ctx context.Context, address string) (map[string]*dto.MetricFamily, error) {
-	_, _, err := net.SplitHostPort(address)
-	if err != nil {
-		address = address + ":2181"
-	}
+func (p *Collector) gatherServer(server *Server) *serverMetrics {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Timeout))
+	defer cancel()
 
-	c, err := p.dial(ctx, address)
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	s := newServerMetrics()
+	switch server.Mode {
+	case modeAdmin:
+		s.err = p.gatherAdmin(ctx, server, s)
+	default:
+		s.err = p.gather4lw(ctx, server, s)
+	}
+	s.duration = time.Since(start)
+	if s.err != nil {
+		return s
 	}
-	defer c.Close()
 
-	// Apply deadline to connection
-	deadline, ok := ctx.Deadline()
-	if ok {
-		if err := c.SetDeadline(deadline); err != nil {
-			return nil, err
+	labels := p.serverLabels(server)
+	for _, mf := range s.metrics {
+		for _, metric := range mf.GetMetric() {
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: &labelState, Value: &s.state})
+			for i := 0; i+1 < len(labels); i += 2 {
+				key, value := labels[i], labels[i+1]
+				metric.Label = append(metric.Label, &dto.LabelPair{Name: &key, Value: &value})
+			}
 		}
 	}
 
-	if _, err := fmt.Fprintf(c, "%s\n", "mntr"); err != nil {
-		return nil, err
-	}
-	rdr := bufio.NewReader(c)
-	scanner := bufio.NewScanner(rdr)
+	return s
+}
 
-	service := strings.Split(address, ":")
-	if len(service) != 2 {
-		return nil, fmt.Errorf("invalid service address: %s", address)
+// init checks the server and sets the labels
+func (p *Server) init(commands []string) error {
+	if p.Mode == "" {
+		p.Mode = mode4lw
 	}
-
-	srv := "localhost"
-	if service[0] != "" {
-		srv = service[0]
+	if len(p.Commands) == 0 {
+		p.Commands = commands
 	}
 
-	var metrics = make(map[string]*dto.MetricFamily)
-	var zookeeperState string
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := zookeeperFormatRE.FindStringSubmatch(line)
-
-		if len(parts) != 3 {
-			return nil, fmt.Errorf("unexpected line in mntr response: %q", line)
+	switch p.Mode {
+	case mode4lw:
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			p.Address = p.Address + ":" + default4lwPort
 		}
-
-		//metricName := strings.TrimPrefix(parts[1], "zk_")
-		//if metricName == "server_state" {
-		//	zookeeperState = parts[2]
-		//} else {
-		//	sValue := parts[2]
-		//
-		//	iVal, err := strconv.ParseInt(sValue, 10, 64)
-		//	if err == nil {
-		//		fields[measurement] = iVal
-		//	} else {
-		//		fields[measurement] = sValue
-		//	}
-		//}
-
-		//measurement := strings.TrimPrefix(parts[1], "zk_") // 社区去掉了zk_
-		metricName := fmt.Sprintf("%s%s", metricPrefix, parts[1])
-
-		mf, ok := metrics[metricName]
-		if !ok {
-			typ := dto.MetricType_UNTYPED
-			mf = &dto.MetricFamily{
-				Name: &metricName,
-				Type: &typ,
+		p.instance = p.Address
+		for _, cmd := range p.Commands {
+			switch cmd {
+			case cmdMntr, cmdSrvr, cmdCons, cmdWchs, cmdWchc, cmdEnvi, cmdRuok:
+			default:
+				return fmt.Errorf("unsupported command %s of zookeeper %s", cmd, p.Address)
 			}
 		}
-
-		if metricName == zkServerStateName {
-			zookeeperState = parts[2]
-			mf.Metric = append(mf.Metric, &dto.Metric{
-				Untyped: &dto.Untyped{Value: &defaultValue},
-			})
-		} else if metricName == zkVersionName {
-			mf.Metric = append(mf.Metric, &dto.Metric{
-				Label: []*dto.LabelPair{
-					{Name: &parts[1], Value: &parts[2]},
-				},
-				Untyped: &dto.Untyped{Value: &defaultValue},
-			})
-
-		} else {
-			sValue := parts[2]
-			iVal, err := strconv.ParseFloat(sValue, 64)
-			if err == nil {
-				mf.Metric = append(mf.Metric, &dto.Metric{
-					Untyped: &dto.Untyped{Value: &iVal},
-				})
-			}
+	case modeAdmin:
+		u, err := url.Parse(p.Address)
+		if err != nil {
+			return err
 		}
-		metrics[metricName] = mf
-	}
-
-	for _, mf := range metrics {
-		for i, metric := range mf.GetMetric() {
-			metric.Label = append(metric.Label,
-				&dto.LabelPair{Name: &labelState, Value: &zookeeperState},
-				&dto.LabelPair{Name: &labelInstance, Value: &address},
-				&dto.LabelPair{Name: &labelServer, Value: &srv},
-				&dto.LabelPair{Name: &labelPort, Value: &service[1]})
-			mf.GetMetric()[i] = metric
-			for k, v := range p.Tags {
-				key, value := k, v //
-				metric.Label = append(metric.Label, &dto.LabelPair{Name: &key, Value: &value})
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid admin server url of zookeeper: %s", p.Address)
+		}
+		p.instance = u.Host
+		for _, cmd := range p.Commands {
+			if _, ok := adminCommands[cmd]; !ok {
+				return fmt.Errorf("unsupported command %s of zookeeper admin server %s", cmd, p.Address)
 			}
 		}
+	default:
+		return fmt.Errorf("unsupported mode %s of zookeeper %s", p.Mode, p.Address)
 	}
 
-	return metrics, nil
+	host, port, err := net.SplitHostPort(p.instance)
+	if err != nil {
+		return fmt.Errorf("invalid service address: %s", p.Address)
+	}
+	p.host, p.port = "localhost", port
+	if host != "" {
+		p.host = host
+	}
+	return nil
 }
 
 func init() {
@@ -261,6 +348,10 @@ func init() {
 			}
 		}
 
+		if p.Timeout < types.Duration(1*time.Second) {
+			p.Timeout = types.Duration(defaultTimeout)
+		}
+
 		if p.TlsConfig != nil {
 			tlsConfig, err := p.TlsConfig.GetTLSConfig()
 			if err != nil {
@@ -269,6 +360,34 @@ func init() {
 			p.tlsConfig = tlsConfig
 		}
 
+		p.client = &http.Client{
+			Timeout: time.Duration(p.Timeout),
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: p.tlsConfig,
+			},
+		}
+
+		if len(p.Commands) == 0 {
+			p.Commands = []string{cmdMntr}
+		}
+		if len(p.Servers) == 0 && len(p.Endpoints) == 0 {
+			p.Servers = []string{":2181"}
+		}
+		for _, address := range p.Servers {
+			p.servers = append(p.servers, &Server{Address: address, Cluster: p.Cluster})
+		}
+		for _, server := range p.Endpoints {
+			if server != nil {
+				p.servers = append(p.servers, server)
+			}
+		}
+		for _, server := range p.servers {
+			if err := server.init(p.Commands); err != nil {
+				return nil, err
+			}
+		}
+
 		return p, nil
 	})
 }
@@ -0,0 +1,354 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package zookeeper
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+var fourLetterWords = map[string]string{
+	cmdMntr: "zk_version\t3.6.3--6401e4ad, built on 04/08/2021 16:35 GMT\n" +
+		"zk_server_state\tleader\n" +
+		"zk_packets_received\t10\n" +
+		"zk_znode_count\t5\n" +
+		"zk_synced_followers\t2\n" +
+		"zk_p99_ack_latency\t3\n" +
+		"zk_cnt_ack_latency\t7\n" +
+		"zk_sum_ack_latency\t12\n",
+	cmdSrvr: "Zookeeper version: 3.6.3--6401e4ad, built on 04/08/2021 16:35 GMT\n" +
+		"Latency min/avg/max: 0/0.1/3\n" +
+		"Received: 5\n" +
+		"Sent: 4\n" +
+		"Connections: 1\n" +
+		"Outstanding: 0\n" +
+		"Zxid: 0x100000002\n" +
+		"Mode: leader\n" +
+		"Node count: 5\n",
+	cmdCons: " /127.0.0.1:54860[1](queued=0,recved=1,sent=1,sid=0x100001,lop=SESS,est=1,to=30000,lcxid=0x0,lzxid=0x1,lresp=1,llat=0,minlat=0,avglat=0,maxlat=2)\n\n",
+	cmdWchs: "1 connections watching 2 paths\nTotal watches:3\n",
+	cmdWchc: "0x100001\n\t/foo\n\t/bar\n",
+	cmdEnvi: "Environment:\nzookeeper.version=3.6.3--6401e4ad, built on x\njava.version=11.0.11\nos.name=Linux\n",
+	cmdRuok: "imok",
+}
+
+// fakeServer serves the four letter words of the responses, the others are not in the whitelist
+func fakeServer(t *testing.T, responses map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				cmd := strings.TrimSpace(line)
+				resp, ok := responses[cmd]
+				if !ok {
+					resp = cmd + " is not executed because it is not in the whitelist.\n"
+				}
+				fmt.Fprint(c, resp)
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func newTestCollector(t *testing.T, servers ...*Server) *Collector {
+	p := &Collector{
+		logger:  log.NewNopLogger(),
+		client:  &http.Client{Timeout: time.Second},
+		Timeout: types.Duration(time.Second),
+		servers: servers,
+	}
+	for _, server := range servers {
+		if err := server.init([]string{cmdMntr}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// findMetric returns the metric of the family with all the label pairs
+func findMetric(mfs []*dto.MetricFamily, name string, labels ...string) *dto.Metric {
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range mf.GetMetric() {
+			for i := 0; i+1 < len(labels); i += 2 {
+				if getLabel(metric, labels[i]) != labels[i+1] {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	return nil
+}
+
+func getLabel(metric *dto.Metric, name string) string {
+	for _, pair := range metric.GetLabel() {
+		if pair.GetName() == name {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Counter != nil:
+		return metric.GetCounter().GetValue()
+	case metric.Gauge != nil:
+		return metric.GetGauge().GetValue()
+	default:
+		return metric.GetUntyped().GetValue()
+	}
+}
+
+func expectValue(t *testing.T, mfs []*dto.MetricFamily, expected float64, name string, labels ...string) {
+	t.Helper()
+	metric := findMetric(mfs, name, labels...)
+	if metric == nil {
+		t.Errorf("metric %s%v not found", name, labels)
+		return
+	}
+	if value := metricValue(metric); value != expected {
+		t.Errorf("metric %s%v = %v, expected %v", name, labels, value, expected)
+	}
+}
+
+func TestGather4lw(t *testing.T) {
+	address := fakeServer(t, fourLetterWords)
+	p := newTestCollector(t, &Server{
+		Address:  address,
+		Commands: []string{cmdMntr, cmdSrvr, cmdCons, cmdWchs, cmdWchc, cmdEnvi, cmdRuok},
+	})
+
+	mfs, err := p.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, mfs, 1, metricUpName, labelInstance, address)
+	expectValue(t, mfs, 1, "zookeeper_zk_server_state", labelServerState, "leader", labelState, "leader")
+	expectValue(t, mfs, 0, "zookeeper_zk_server_state", labelServerState, "follower")
+	expectValue(t, mfs, 1, "zookeeper_zk_version", labelVersion, "3.6.3--6401e4ad")
+	expectValue(t, mfs, 10, "zookeeper_zk_packets_received", labelInstance, address)
+	expectValue(t, mfs, 5, "zookeeper_zk_znode_count")
+	expectValue(t, mfs, 3, "zookeeper_srvr_latency_max")
+	expectValue(t, mfs, 0x100000002, "zookeeper_srvr_zxid")
+	expectValue(t, mfs, 1, "zookeeper_srvr_mode", "mode", "leader")
+	expectValue(t, mfs, 1, "zookeeper_connection_received_total", "client", "127.0.0.1:54860", "session_id", "0x100001")
+	expectValue(t, mfs, 2, "zookeeper_connection_max_latency", "client", "127.0.0.1:54860")
+	expectValue(t, mfs, 3, "zookeeper_watches")
+	expectValue(t, mfs, 2, "zookeeper_watch_paths")
+	expectValue(t, mfs, 2, "zookeeper_session_watches", "session_id", "0x100001")
+	expectValue(t, mfs, 1, "zookeeper_env_info", "java_version", "11.0.11", "os_name", "Linux")
+	expectValue(t, mfs, 1, "zookeeper_ruok")
+
+	metric := findMetric(mfs, "zookeeper_zk_ack_latency")
+	if metric == nil || metric.Summary == nil {
+		t.Fatalf("summary zookeeper_zk_ack_latency not found")
+	}
+	if summary := metric.GetSummary(); summary.GetSampleCount() != 7 || summary.GetSampleSum() != 12 ||
+		len(summary.GetQuantile()) != 1 || summary.GetQuantile()[0].GetQuantile() != 0.99 {
+		t.Errorf("unexpected summary zookeeper_zk_ack_latency: %v", summary)
+	}
+}
+
+func TestGather4lwNotInWhitelist(t *testing.T) {
+	address := fakeServer(t, map[string]string{})
+	p := newTestCollector(t,
+		&Server{Address: address, Commands: []string{cmdRuok}},
+		&Server{Address: address, Commands: []string{cmdMntr}},
+	)
+
+	mfs, err := p.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ruok is not an error, it reports 0
+	expectValue(t, mfs, 0, "zookeeper_ruok")
+	var values []float64
+	for _, mf := range mfs {
+		if mf.GetName() == metricUpName {
+			for _, metric := range mf.GetMetric() {
+				values = append(values, metricValue(metric))
+			}
+		}
+	}
+	if len(values) != 2 || values[0]+values[1] != 1 {
+		t.Errorf("unexpected %s: %v, expected one server up", metricUpName, values)
+	}
+}
+
+func TestMntrSummaryOfGauge(t *testing.T) {
+	for _, lines := range [][]string{
+		{"zk_ack_latency\t5", "zk_p99_ack_latency\t3", "zk_cnt_ack_latency\t7"},
+		{"zk_p99_ack_latency\t3", "zk_ack_latency\t5", "zk_cnt_ack_latency\t7"},
+	} {
+		s := newServerMetrics()
+		s.parseMntr([]byte(strings.Join(lines, "\n")), log.NewNopLogger())
+
+		gauge := s.metrics["zookeeper_zk_ack_latency"]
+		if gauge.GetType() != dto.MetricType_GAUGE || len(gauge.GetMetric()) != 1 ||
+			gauge.GetMetric()[0].GetGauge().GetValue() != 5 {
+			t.Errorf("unexpected gauge of %v: %v", lines, gauge)
+		}
+		summary := s.metrics["zookeeper_zk_ack_latency"+summarySuffix]
+		if summary.GetName() != "zookeeper_zk_ack_latency"+summarySuffix || summary.GetType() != dto.MetricType_SUMMARY ||
+			len(summary.GetMetric()) != 1 || summary.GetMetric()[0].GetSummary().GetSampleCount() != 7 ||
+			len(summary.GetMetric()[0].GetSummary().GetQuantile()) != 1 {
+			t.Errorf("unexpected summary of %v: %v", lines, summary)
+		}
+	}
+}
+
+func TestGatherAdmin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/commands/" + adminMonitor:
+			fmt.Fprint(w, `{"version":"3.6.3--6401e4ad, built on x","server_state":"follower","znode_count":5,`+
+				`"packets_received":10,"p99_ack_latency":3,"cnt_ack_latency":7,"command":"monitor","error":null}`)
+		case "/commands/" + adminConnections:
+			fmt.Fprint(w, `{"connections":[{"remote_socket_address":"/127.0.0.1:54860","session_id":"0x100001",`+
+				`"outstanding_requests":0,"packets_received":3,"packets_sent":2,"session_timeout":30000,`+
+				`"min_latency":0,"avg_latency":1,"max_latency":2}],"secure_connections":[],"command":"connections","error":null}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	p := newTestCollector(t, &Server{Address: ts.URL, Mode: modeAdmin, Commands: []string{cmdMntr, cmdCons}})
+	mfs, err := p.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance := strings.TrimPrefix(ts.URL, "http://")
+	expectValue(t, mfs, 1, metricUpName, labelInstance, instance)
+	expectValue(t, mfs, 1, "zookeeper_zk_server_state", labelServerState, "follower", labelState, "follower")
+	expectValue(t, mfs, 1, "zookeeper_zk_version", labelVersion, "3.6.3--6401e4ad")
+	expectValue(t, mfs, 5, "zookeeper_zk_znode_count")
+	expectValue(t, mfs, 10, "zookeeper_zk_packets_received")
+	expectValue(t, mfs, 3, "zookeeper_connection_received_total", "client", "127.0.0.1:54860", "session_id", "0x100001")
+	expectValue(t, mfs, 30000, "zookeeper_connection_session_timeout_ms", "client", "127.0.0.1:54860")
+
+	metric := findMetric(mfs, "zookeeper_zk_ack_latency")
+	if metric == nil || metric.GetSummary().GetSampleCount() != 7 {
+		t.Errorf("unexpected summary zookeeper_zk_ack_latency: %v", metric)
+	}
+}
+
+func TestGatherAdminError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	p := newTestCollector(t, &Server{Address: ts.URL, Mode: modeAdmin})
+	mfs, err := p.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, mfs, 0, metricUpName, labelInstance, strings.TrimPrefix(ts.URL, "http://"))
+	if metric := findMetric(mfs, "zookeeper_zk_server_state"); metric != nil {
+		t.Errorf("unexpected metric of the failed server: %v", metric)
+	}
+}
+
+// srvrServer serves srvr with the zxid and the mode
+func srvrServer(t *testing.T, zxid uint64, mode string) *Server {
+	address := fakeServer(t, map[string]string{
+		cmdSrvr: fmt.Sprintf("Zookeeper version: 3.6.3--6401e4ad, built on 04/08/2021 16:35 GMT\nZxid: 0x%x\nMode: %s\n", zxid, mode),
+	})
+	return &Server{Address: address, Commands: []string{cmdSrvr}, Cluster: "zk"}
+}
+
+// downServer returns a server of an address which refuses the connections
+func downServer(t *testing.T) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+	return &Server{Address: address, Commands: []string{cmdSrvr}, Cluster: "zk"}
+}
+
+func TestGatherEnsemble(t *testing.T) {
+	p := newTestCollector(t,
+		srvrServer(t, 0x100000010, stateLeader),
+		srvrServer(t, 0x10000000c, stateFollower),
+		srvrServer(t, 0x100000010, stateFollower),
+		downServer(t),
+	)
+
+	mfs, err := p.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, mfs, 4, "zookeeper_ensemble_servers", labelCluster, "zk")
+	expectValue(t, mfs, 3, "zookeeper_ensemble_servers_up", labelCluster, "zk")
+	expectValue(t, mfs, 1, "zookeeper_ensemble_leaders", labelCluster, "zk")
+	expectValue(t, mfs, 2, "zookeeper_ensemble_followers", labelCluster, "zk")
+	expectValue(t, mfs, 0, "zookeeper_ensemble_observers", labelCluster, "zk")
+	expectValue(t, mfs, 3, "zookeeper_ensemble_quorum_size", labelCluster, "zk")
+	expectValue(t, mfs, 1, "zookeeper_ensemble_quorum_healthy", labelCluster, "zk")
+	expectValue(t, mfs, 3, "zookeeper_ensemble_expected_followers", labelCluster, "zk")
+	expectValue(t, mfs, 4, "zookeeper_ensemble_max_zxid_lag", labelCluster, "zk")
+}
+
+func TestGatherEnsembleEpochs(t *testing.T) {
+	// the follower of the previous epoch has a larger counter, its lag is unknown
+	p := newTestCollector(t,
+		srvrServer(t, 0x200000001, stateLeader),
+		srvrServer(t, 0x100000020, stateFollower),
+		srvrServer(t, 0x200000001, stateFollower),
+	)
+
+	mfs, err := p.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, mfs, 1, "zookeeper_ensemble_quorum_healthy", labelCluster, "zk")
+	if metric := findMetric(mfs, "zookeeper_ensemble_max_zxid_lag"); metric != nil {
+		t.Errorf("unexpected zxid lag of the servers in different epochs: %v", metric)
+	}
+}
@@ -15,5 +15,10 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package all
 
 import (
+	_ "trellis.tech/kolekti/prome_exporters/plugins/outputs/file"
+	_ "trellis.tech/kolekti/prome_exporters/plugins/outputs/graphite"
 	_ "trellis.tech/kolekti/prome_exporters/plugins/outputs/http"
+	_ "trellis.tech/kolekti/prome_exporters/plugins/outputs/influxdb"
+	_ "trellis.tech/kolekti/prome_exporters/plugins/outputs/opentsdb"
+	_ "trellis.tech/kolekti/prome_exporters/plugins/outputs/pushgateway"
 )
@@ -0,0 +1,145 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package file
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/outputs"
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	fileStdout = "stdout"
+	fileStderr = "stderr"
+)
+
+type File struct {
+	// Files are the paths written to, "stdout" and "stderr" are the standard streams
+	Files []string `yaml:"files" json:"files"`
+
+	// RotationMaxSize rotates a file before it grows over the bytes, 0 disables it
+	RotationMaxSize int64 `yaml:"rotation_max_size" json:"rotation_max_size"`
+	// RotationInterval rotates a file which is opened for longer than it, 0 disables it
+	RotationInterval types.Duration `yaml:"rotation_interval" json:"rotation_interval"`
+	// RotationMaxArchives is the number of rotated files kept, 0 keeps all
+	RotationMaxArchives int `yaml:"rotation_max_archives" json:"rotation_max_archives"`
+	// Compress gzips the rotated files
+	Compress bool `yaml:"compress" json:"compress"`
+
+	SerializerConfig serializers.SerializerConfig `yaml:"serializer_config" json:"serializer_config"`
+
+	serializer serializers.Serializer
+	writers    []io.Writer
+	closers    []io.Closer
+}
+
+func (p *File) SampleConfig() string {
+	return ""
+}
+
+func (p *File) Description() string {
+	return "A plugin that writes metrics to files or the standard streams"
+}
+
+func (p *File) Connect() error {
+	if len(p.Files) == 0 {
+		p.Files = []string{fileStdout}
+	}
+
+	for _, file := range p.Files {
+		switch strings.ToLower(file) {
+		case fileStdout:
+			p.writers = append(p.writers, os.Stdout)
+		case fileStderr:
+			p.writers = append(p.writers, os.Stderr)
+		default:
+			w, err := newRotateWriter(file, p.RotationMaxSize, time.Duration(p.RotationInterval), p.RotationMaxArchives, p.Compress)
+			if err != nil {
+				_ = p.Close()
+				return err
+			}
+			p.writers = append(p.writers, w)
+			p.closers = append(p.closers, w)
+		}
+	}
+	return nil
+}
+
+func (p *File) Close() error {
+	var errs []string
+	for _, c := range p.closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	p.writers, p.closers = nil, nil
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close files: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *File) Write(metrics []*dto.MetricFamily) error {
+	body, err := p.serializer.SerializeBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for i, w := range p.writers {
+		if _, err := w.Write(body); err != nil {
+			errs = append(errs, fmt.Sprintf("[%s] %v", p.Files[i], err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to write files: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func init() {
+	outputs.RegisterFactory("file", func(opts ...plugins.Option) (plugins.Output, error) {
+		options := &plugins.Options{}
+		for _, opt := range opts {
+			opt(options)
+		}
+
+		p := &File{}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		p.SerializerConfig.Logger = options.Logger
+		p.serializer, err = serializers.NewSerializer(&p.SerializerConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
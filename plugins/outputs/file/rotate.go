@@ -0,0 +1,219 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package file
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	archiveTimeFormat = "20060102T150405.000"
+	archiveGzipSuffix = ".gz"
+	tmpSuffix         = ".tmp"
+)
+
+// rotateWriter writes to a file which is rotated by size and age. A rotated file
+// is renamed to "<name>.<time>", and gzipped to "<name>.<time>.gz" if compress.
+type rotateWriter struct {
+	filename    string
+	maxSize     int64
+	interval    time.Duration
+	maxArchives int
+	compress    bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newRotateWriter(filename string, maxSize int64, interval time.Duration, maxArchives int, compress bool) (*rotateWriter, error) {
+	w := &rotateWriter{
+		filename:    filename,
+		maxSize:     maxSize,
+		interval:    interval,
+		maxArchives: maxArchives,
+		compress:    compress,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.file = f
+	w.size = fi.Size()
+	w.openedAt = time.Now()
+	return nil
+}
+
+// Write writes to the file, a failed rotation is returned after the bytes are written to the
+// file reopened, and it is retried at the next write
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	var rotateErr error
+	if w.shouldRotate(int64(len(p))) {
+		if rotateErr = w.rotate(); rotateErr != nil && w.file == nil {
+			return 0, rotateErr
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("rotate %s failed: %w", w.filename, rotateErr)
+	}
+	return n, err
+}
+
+func (w *rotateWriter) shouldRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxSize > 0 && w.size+n > w.maxSize {
+		return true
+	}
+	return w.interval > 0 && time.Since(w.openedAt) >= w.interval
+}
+
+// rotate renames the file to an archive and opens a new file. If the rename or the open fails,
+// the file is opened again for appending, so the writer is not left with a closed file.
+func (w *rotateWriter) rotate() error {
+	closeErr := w.file.Close()
+	w.file = nil
+	if closeErr != nil {
+		return w.reopen(closeErr)
+	}
+
+	archive := w.filename + "." + time.Now().Format(archiveTimeFormat)
+	if err := os.Rename(w.filename, archive); err != nil {
+		return w.reopen(err)
+	}
+	if err := w.open(); err != nil {
+		// the archive is renamed back, the file may not be created but it can be opened
+		if renameErr := os.Rename(archive, w.filename); renameErr != nil {
+			return fmt.Errorf("%v, and rename %s back failed: %v", err, archive, renameErr)
+		}
+		return w.reopen(err)
+	}
+
+	if w.compress {
+		if err := gzipFile(archive); err != nil {
+			return err
+		}
+	}
+	return w.removeArchives()
+}
+
+// reopen opens the file for appending after a failed rotation, the error of the rotation is returned
+func (w *rotateWriter) reopen(err error) error {
+	if openErr := w.open(); openErr != nil {
+		return fmt.Errorf("%v, and reopen failed: %v", err, openErr)
+	}
+	return err
+}
+
+// removeArchives keeps the newest maxArchives archives, all are kept if maxArchives <= 0.
+func (w *rotateWriter) removeArchives() error {
+	if w.maxArchives <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(w.filename + ".*")
+	if err != nil {
+		return err
+	}
+
+	var archives []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, w.filename+"."), archiveGzipSuffix)
+		if _, err := time.Parse(archiveTimeFormat, suffix); err == nil {
+			archives = append(archives, match)
+		}
+	}
+	if len(archives) <= w.maxArchives {
+		return nil
+	}
+
+	// the time format sorts as the rotation order
+	sort.Strings(archives)
+	for _, archive := range archives[:len(archives)-w.maxArchives] {
+		if err := os.Remove(archive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *rotateWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// gzipFile compresses the file to a temporary file which is renamed to "<filename>.gz",
+// so that a partial archive is never visible, then removes the file.
+func gzipFile(filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := filename + archiveGzipSuffix + tmpSuffix
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(dst)
+	if _, err = io.Copy(gw, src); err == nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, filename+archiveGzipSuffix); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, filename string) string {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestRotateWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.out")
+	w, err := newRotateWriter(filename, 10, 0, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// the archives are named by the time in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if content := readFile(t, filename); content != "third\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	archives, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 || readFile(t, archives[0]) != "second\n" {
+		t.Errorf("unexpected archives %v, expected the one of the second line", archives)
+	}
+}
+
+func TestRotateWriterFailedRotation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.out")
+	w, err := newRotateWriter(filename, 10, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the file removed fails the rename of the rotation
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := w.Write([]byte("second\n"))
+	if err == nil {
+		t.Errorf("expected the error of the rotation")
+	}
+	if n != len("second\n") {
+		t.Errorf("unexpected bytes written %d after the failed rotation", n)
+	}
+
+	// the writer is recovered, the file is rotated at the next write
+	if content := readFile(t, filename); content != "second\n" {
+		t.Errorf("unexpected content %q after the failed rotation", content)
+	}
+	if _, err := w.Write([]byte("third\n")); err != nil {
+		t.Fatalf("write after the failed rotation: %v", err)
+	}
+	if content := readFile(t, filename); content != "third\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+}
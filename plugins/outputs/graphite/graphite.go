@@ -0,0 +1,235 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package graphite
+
+import (
+	"bytes"
+	tls2 "crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/outputs"
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/crypto/tls"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	defaultServer     = "127.0.0.1:2003"
+	defaultTimeout    = 5 * time.Second
+	defaultSerializer = "graphite"
+	// keeps the datagrams under the common MTU
+	defaultUDPPayload = 1432
+)
+
+const (
+	protocolTCP = "tcp"
+	protocolUDP = "udp"
+)
+
+type Graphite struct {
+	// Servers are tried in order, the metrics are written to the first one accepting them
+	Servers []string `yaml:"servers" json:"servers"`
+	// Protocol is tcp or udp, defaults tcp
+	Protocol string `yaml:"protocol" json:"protocol"`
+	// UDPPayload is the max size of a datagram in udp protocol
+	UDPPayload int `yaml:"udp_payload" json:"udp_payload"`
+
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+
+	SerializerConfig serializers.SerializerConfig `yaml:"serializer_config" json:"serializer_config"`
+
+	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
+
+	logger     log.Logger
+	timeout    time.Duration
+	tlsConfig  *tls2.Config
+	serializer serializers.Serializer
+	conns      []net.Conn
+}
+
+func (p *Graphite) SampleConfig() string {
+	return ""
+}
+
+func (p *Graphite) Description() string {
+	return "A plugin that writes metrics to graphite with the plaintext protocol"
+}
+
+func (p *Graphite) Connect() error {
+	if len(p.Servers) == 0 {
+		p.Servers = []string{defaultServer}
+	}
+	if p.Protocol == "" {
+		p.Protocol = protocolTCP
+	}
+	if p.Protocol != protocolTCP && p.Protocol != protocolUDP {
+		return fmt.Errorf("unsupported graphite protocol: %s", p.Protocol)
+	}
+	if p.UDPPayload <= 0 {
+		p.UDPPayload = defaultUDPPayload
+	}
+
+	// the servers not reachable now are dialed again by Write
+	p.conns = make([]net.Conn, len(p.Servers))
+	for i := range p.Servers {
+		if err := p.dial(i); err != nil {
+			level.Warn(p.logger).Log("msg", "graphite_connect_failed", "server", p.Servers[i], "error", err)
+		}
+	}
+	return nil
+}
+
+func (p *Graphite) dial(i int) error {
+	dialer := &net.Dialer{Timeout: p.timeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if p.Protocol == protocolTCP && p.tlsConfig != nil {
+		conn, err = tls2.DialWithDialer(dialer, protocolTCP, p.Servers[i], p.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(p.Protocol, p.Servers[i])
+	}
+	if err != nil {
+		return err
+	}
+	p.conns[i] = conn
+	return nil
+}
+
+func (p *Graphite) closeConn(i int) {
+	if p.conns[i] != nil {
+		_ = p.conns[i].Close()
+		p.conns[i] = nil
+	}
+}
+
+func (p *Graphite) Close() error {
+	for i := range p.conns {
+		p.closeConn(i)
+	}
+	return nil
+}
+
+// Write sends the metrics to the first server accepting them, the servers
+// whose connection was lost are reconnected before being tried.
+func (p *Graphite) Write(metrics []*dto.MetricFamily) error {
+	body, err := p.serializer.SerializeBatch(metrics)
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil
+	}
+
+	for i := range p.Servers {
+		if p.conns[i] == nil {
+			if err = p.dial(i); err != nil {
+				level.Warn(p.logger).Log("msg", "graphite_reconnect_failed", "server", p.Servers[i], "error", err)
+				continue
+			}
+		}
+
+		if err = p.send(p.conns[i], body); err == nil {
+			return nil
+		}
+		level.Warn(p.logger).Log("msg", "graphite_write_failed", "server", p.Servers[i], "error", err)
+		p.closeConn(i)
+	}
+
+	return fmt.Errorf("failed to write to any of graphite servers: %s, last error: %v", strings.Join(p.Servers, ","), err)
+}
+
+func (p *Graphite) send(conn net.Conn, body []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(p.timeout)); err != nil {
+		return err
+	}
+
+	if p.Protocol == protocolTCP {
+		_, err := conn.Write(body)
+		return err
+	}
+
+	// udp datagrams end at a line end, a line larger than the payload is sent alone
+	for len(body) > 0 {
+		n := len(body)
+		if n > p.UDPPayload {
+			if n = bytes.LastIndexByte(body[:p.UDPPayload], '\n') + 1; n == 0 {
+				if n = bytes.IndexByte(body, '\n') + 1; n == 0 {
+					n = len(body)
+				}
+			}
+		}
+		if _, err := conn.Write(body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return nil
+}
+
+func init() {
+	outputs.RegisterFactory("graphite", func(opts ...plugins.Option) (plugins.Output, error) {
+		options := &plugins.Options{}
+		for _, opt := range opts {
+			opt(options)
+		}
+
+		p := &Graphite{
+			logger: options.Logger,
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		if p.TlsConfig != nil {
+			tlsConfig, err := p.TlsConfig.GetTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			p.tlsConfig = tlsConfig
+		}
+
+		p.timeout = defaultTimeout
+		if p.Timeout != 0 {
+			p.timeout = time.Duration(p.Timeout)
+		}
+
+		if p.SerializerConfig.Name == "" {
+			p.SerializerConfig.Name = defaultSerializer
+		}
+
+		var err error
+		p.SerializerConfig.Logger = options.Logger
+		p.serializer, err = serializers.NewSerializer(&p.SerializerConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package http
+
+import (
+	dto "github.com/prometheus/client_model/go"
+)
+
+// part is a family, or a part of its series, with its serialized size
+type part struct {
+	family *dto.MetricFamily
+	size   int
+}
+
+// bodies serializes the metrics into request bodies not larger than MaxBodyBytes,
+// a single series larger than it is sent alone.
+func (h *HTTP) bodies(metrics []*dto.MetricFamily) ([][]byte, error) {
+	if h.MaxBodyBytes <= 0 {
+		body, err := h.serializer.SerializeBatch(metrics)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{body}, nil
+	}
+
+	var parts []part
+	for _, mf := range metrics {
+		ps, err := h.splitFamily(mf)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, ps...)
+	}
+
+	var (
+		bodies [][]byte
+		group  []*dto.MetricFamily
+		size   int
+	)
+	for _, p := range parts {
+		if len(group) > 0 && size+p.size > h.MaxBodyBytes {
+			bs, err := h.serializeGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			bodies = append(bodies, bs...)
+			group, size = nil, 0
+		}
+		group = append(group, p.family)
+		size += p.size
+	}
+	if len(group) > 0 {
+		bs, err := h.serializeGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, bs...)
+	}
+	return bodies, nil
+}
+
+// splitFamily halves the series of the family until every part fits MaxBodyBytes
+func (h *HTTP) splitFamily(mf *dto.MetricFamily) ([]part, error) {
+	bs, err := h.serializer.Serialize(mf)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) <= h.MaxBodyBytes || len(mf.GetMetric()) <= 1 {
+		return []part{{family: mf, size: len(bs)}}, nil
+	}
+
+	half := len(mf.GetMetric()) / 2
+	var parts []part
+	for _, metrics := range [][]*dto.Metric{mf.GetMetric()[:half], mf.GetMetric()[half:]} {
+		ps, err := h.splitFamily(&dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: metrics})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, ps...)
+	}
+	return parts, nil
+}
+
+// serializeGroup serializes the families as one body, or halves them when the
+// body of the whole group, which may be framed by the serializer, is too large.
+func (h *HTTP) serializeGroup(group []*dto.MetricFamily) ([][]byte, error) {
+	body, err := h.serializer.SerializeBatch(group)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) <= h.MaxBodyBytes || len(group) <= 1 {
+		return [][]byte{body}, nil
+	}
+
+	half := len(group) / 2
+	first, err := h.serializeGroup(group[:half])
+	if err != nil {
+		return nil, err
+	}
+	second, err := h.serializeGroup(group[half:])
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
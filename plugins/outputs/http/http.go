@@ -21,9 +21,11 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"trellis.tech/kolekti/prome_exporters/internal"
+	"trellis.tech/kolekti/prome_exporters/internal/auth"
 	"trellis.tech/kolekti/prome_exporters/plugins"
 	"trellis.tech/kolekti/prome_exporters/plugins/outputs"
 	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
@@ -46,22 +48,31 @@ const (
 )
 
 type HTTP struct {
-	URL                     string            `yaml:"url"`
-	Method                  string            `yaml:"method"`
-	Username                string            `yaml:"username"`
-	Password                string            `yaml:"password"`
-	Headers                 map[string]string `yaml:"headers"`
-	ContentEncoding         string            `yaml:"content_encoding"`
-	NonRetryableStatusCodes []int             `yaml:"non_retryable_statuscodes"`
+	URL             string            `yaml:"url"`
+	Method          string            `yaml:"method"`
+	Headers         map[string]string `yaml:"headers"`
+	ContentEncoding string            `yaml:"content_encoding"`
+	// ContentEncodingLevel is the compression level of the content encoding, 0 is the default level
+	ContentEncodingLevel    int   `yaml:"content_encoding_level"`
+	NonRetryableStatusCodes []int `yaml:"non_retryable_statuscodes"`
 
 	Timeout types.Duration `yaml:"timeout" json:"timeout"`
 
+	// MaxBodyBytes splits the metrics into requests whose bodies are not larger
+	// than it, a family is split by series when needed. 0 is not limited
+	MaxBodyBytes int `yaml:"max_body_bytes" json:"max_body_bytes"`
+	// MaxConcurrentRequests is the number of requests sent at the same time, defaults 1
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests" json:"max_concurrent_requests"`
+
+	Auth auth.Config `yaml:",inline" json:",inline"`
+
 	SerializerConfig serializers.SerializerConfig `yaml:"serializer_config" json:"serializer_config"`
 
 	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
 
 	client     *http.Client
 	serializer serializers.Serializer
+	compressor internal.Compressor
 
 	PrintMetrics bool `yaml:"print_metrics" json:"print_metrics"`
 }
@@ -84,6 +95,10 @@ func (h *HTTP) Connect() error {
 		h.URL = defaultURL
 	}
 
+	if h.MaxConcurrentRequests <= 0 {
+		h.MaxConcurrentRequests = 1
+	}
+
 	return nil
 }
 
@@ -99,50 +114,68 @@ func (h *HTTP) Description() string {
 	return "A plugin that can transmit metrics over HTTP"
 }
 
-func (h *HTTP) Write(metrics []*dto.MetricFamily) (err error) {
-	var reqBody []byte
-	reqBody, err = h.serializer.SerializeBatch(metrics)
+func (h *HTTP) Write(metrics []*dto.MetricFamily) error {
+	bodies, err := h.bodies(metrics)
 	if err != nil {
-		return
+		return err
 	}
 
 	if h.PrintMetrics {
-		fmt.Printf("http_output_metrics\n%s", string(reqBody))
+		for _, reqBody := range bodies {
+			fmt.Printf("http_output_metrics\n%s", string(reqBody))
+		}
 	}
 
-	if err = h.writeMetric(reqBody); err != nil {
-		return
+	if len(bodies) == 1 {
+		return h.writeMetric(bodies[0])
 	}
 
-	return nil
-}
-
-func (h *HTTP) writeMetric(reqBody []byte) error {
-	var reqBodyBuffer io.Reader = bytes.NewBuffer(reqBody)
+	var (
+		errs = make([]error, len(bodies))
+		sem  = make(chan struct{}, h.MaxConcurrentRequests)
+		wg   sync.WaitGroup
+	)
+	for i, reqBody := range bodies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, reqBody []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = h.writeMetric(reqBody)
+		}(i, reqBody)
+	}
+	wg.Wait()
 
-	var err error
-	if h.ContentEncoding == "gzip" {
-		rc, err := internal.CompressWithGzip(reqBodyBuffer)
+	// the errors are reported in the order of the requests
+	var msgs []string
+	for i, err := range errs {
 		if err != nil {
-			return err
+			msgs = append(msgs, fmt.Sprintf("request %d/%d: %v", i+1, len(bodies), err))
 		}
-		defer rc.Close()
-		reqBodyBuffer = rc
 	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%d of %d requests failed: %s", len(msgs), len(bodies), strings.Join(msgs, "; "))
+	}
+	return nil
+}
 
-	req, err := http.NewRequest(h.Method, h.URL, reqBodyBuffer)
+func (h *HTTP) writeMetric(reqBody []byte) error {
+	reqBody, err := h.compressor.Compress(reqBody)
 	if err != nil {
 		return err
 	}
 
-	if h.Username != "" || h.Password != "" {
-		req.SetBasicAuth(h.Username, h.Password)
+	req, err := http.NewRequest(h.Method, h.URL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
 	}
 
 	req.Header.Set("User-Agent", builder.Version())
 	req.Header.Set("Content-Type", defaultContentType)
-	if h.ContentEncoding == "gzip" {
-		req.Header.Set("Content-Encoding", "gzip")
+	if encoding := h.compressor.ContentEncoding(); encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
 	}
 	for k, v := range h.Headers {
 		if strings.ToLower(k) == "host" {
@@ -216,12 +249,23 @@ func init() {
 			timeout = time.Duration(p.Timeout)
 		}
 
+		compressor, err := internal.NewCompressor(p.ContentEncoding, p.ContentEncodingLevel)
+		if err != nil {
+			return nil, err
+		}
+		p.compressor = compressor
+
+		roundTripper, err := p.Auth.NewRoundTripper(transport)
+		if err != nil {
+			return nil, err
+		}
+
 		p.client = &http.Client{
 			Timeout:   timeout,
-			Transport: transport,
+			Transport: roundTripper,
 		}
 
-		var err error
+		p.SerializerConfig.Logger = options.Logger
 		p.serializer, err = serializers.NewSerializer(&p.SerializerConfig)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,365 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package influxdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/internal"
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/outputs"
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/builder"
+	"trellis.tech/trellis/common.v1/crypto/tls"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	maxErrMsgLen        = 1024
+	defaultURL          = "http://127.0.0.1:8086"
+	defaultTimeout      = 10 * time.Second
+	defaultMaxBodyBytes = 1 << 20
+	defaultSerializer   = "influx"
+	defaultContentType  = "text/plain; charset=utf-8"
+)
+
+// maxUnsentBytes limits the lines not sent kept for the next write, the oldest are dropped
+const maxUnsentBytes = 16 << 20
+
+const (
+	version1 = 1
+	version2 = 2
+)
+
+// v1 names the microseconds precision "u"
+var v1Precisions = map[string]string{
+	"ns": "ns",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+type InfluxDB struct {
+	URL string `yaml:"url" json:"url"`
+	// Version of the write api: 1 is /write, 2 is /api/v2/write, defaults 1
+	Version int `yaml:"version" json:"version"`
+
+	// v1
+	Database        string `yaml:"database" json:"database"`
+	RetentionPolicy string `yaml:"retention_policy" json:"retention_policy"`
+	Username        string `yaml:"username" json:"username"`
+	Password        string `yaml:"password" json:"password"`
+
+	// v2
+	Organization string `yaml:"organization" json:"organization"`
+	Bucket       string `yaml:"bucket" json:"bucket"`
+	Token        string `yaml:"token" json:"token"`
+
+	Headers         map[string]string `yaml:"headers" json:"headers"`
+	ContentEncoding string            `yaml:"content_encoding" json:"content_encoding"`
+	// ContentEncodingLevel is the compression level of the content encoding, 0 is the default level
+	ContentEncodingLevel int `yaml:"content_encoding_level" json:"content_encoding_level"`
+	// MaxBodyBytes splits the serialized lines into requests not larger than it
+	MaxBodyBytes int `yaml:"max_body_bytes" json:"max_body_bytes"`
+
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+
+	SerializerConfig serializers.SerializerConfig `yaml:"serializer_config" json:"serializer_config"`
+
+	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
+
+	logger     log.Logger
+	client     *http.Client
+	serializer serializers.Serializer
+	compressor internal.Compressor
+	writeURL   string
+	// unsent are the lines of the batches not sent by the last write, the batches sent before the
+	// failed one are not sent again
+	unsent []byte
+}
+
+func (p *InfluxDB) SampleConfig() string {
+	return ""
+}
+
+func (p *InfluxDB) Description() string {
+	return "A plugin that writes metrics to InfluxDB with the line protocol"
+}
+
+func (p *InfluxDB) Connect() error {
+	if p.URL == "" {
+		p.URL = defaultURL
+	}
+	if p.Version == 0 {
+		p.Version = version1
+	}
+	if p.MaxBodyBytes <= 0 {
+		p.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	compressor, err := internal.NewCompressor(p.ContentEncoding, p.ContentEncodingLevel)
+	if err != nil {
+		return fmt.Errorf("%v [%s]", err, p.URL)
+	}
+	p.compressor = compressor
+
+	precision := "ns"
+	if ps, ok := p.serializer.(interface{ TimestampPrecision() string }); ok {
+		precision = ps.TimestampPrecision()
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	switch p.Version {
+	case version1:
+		if p.Database == "" {
+			return fmt.Errorf("database is required by influxdb v1 [%s]", p.URL)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		params.Set("db", p.Database)
+		if p.RetentionPolicy != "" {
+			params.Set("rp", p.RetentionPolicy)
+		}
+		params.Set("precision", v1Precisions[precision])
+	case version2:
+		if p.Organization == "" || p.Bucket == "" {
+			return fmt.Errorf("organization and bucket are required by influxdb v2 [%s]", p.URL)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		params.Set("org", p.Organization)
+		params.Set("bucket", p.Bucket)
+		params.Set("precision", precision)
+	default:
+		return fmt.Errorf("unsupported influxdb version [%s] %d", p.URL, p.Version)
+	}
+	u.RawQuery = params.Encode()
+	p.writeURL = u.String()
+
+	return nil
+}
+
+func (p *InfluxDB) Close() error {
+	return nil
+}
+
+// Write writes the lines in the batches of MaxBodyBytes. When a batch fails, it and the following
+// batches are kept and written before the lines of the next write, so the batches written are
+// never written again. A batch rejected by a client error such as 400 is dropped
+func (p *InfluxDB) Write(metrics []*dto.MetricFamily) error {
+	body, err := p.serializer.SerializeBatch(metrics)
+	if err != nil {
+		return err
+	}
+	if len(p.unsent) > 0 {
+		body = append(p.unsent, body...)
+		p.unsent = nil
+	}
+
+	var rejected error
+	batches := splitLines(body, p.MaxBodyBytes)
+	for i, batch := range batches {
+		err = p.writeBatch(batch)
+		if se, ok := err.(*statusError); ok && !se.retryable() {
+			// the lines rejected by influxdb, such as the invalid ones, are not written again
+			level.Warn(p.logger).Log("msg", "drop_rejected_batch", "url", p.URL, "error", err)
+			rejected = err
+			continue
+		}
+		if err != nil {
+			p.keepUnsent(body[len(body)-unsentLen(batches[i:]):])
+			return fmt.Errorf("%d of %d batches not written, they are written at the next write: %w", len(batches)-i, len(batches), err)
+		}
+	}
+	return rejected
+}
+
+// statusError is the error of a response not 2xx
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// retryable returns false if the batch is rejected, the client errors except timeout and too many requests
+func (e *statusError) retryable() bool {
+	return e.code < 400 || e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// keepUnsent keeps the lines for the next write, at most maxUnsentBytes of the latest ones
+func (p *InfluxDB) keepUnsent(lines []byte) {
+	if len(lines) > maxUnsentBytes {
+		dropped := lines[:len(lines)-maxUnsentBytes]
+		lines = lines[len(dropped):]
+		// the line cut off is dropped as a whole
+		if i := bytes.IndexByte(lines, '\n'); i >= 0 && dropped[len(dropped)-1] != '\n' {
+			lines = lines[i+1:]
+		}
+		level.Warn(p.logger).Log("msg", "drop_unsent_lines", "url", p.URL, "bytes", len(dropped))
+	}
+	p.unsent = append([]byte(nil), lines...)
+}
+
+func unsentLen(batches [][]byte) int {
+	n := 0
+	for _, batch := range batches {
+		n += len(batch)
+	}
+	return n
+}
+
+func (p *InfluxDB) writeBatch(body []byte) error {
+	body, err := p.compressor.Compress(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.writeURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("User-Agent", builder.Version())
+	req.Header.Set("Content-Type", defaultContentType)
+	if encoding := p.compressor.ContentEncoding(); encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	switch p.Version {
+	case version1:
+		if p.Username != "" || p.Password != "" {
+			req.SetBasicAuth(p.Username, p.Password)
+		}
+	case version2:
+		if p.Token != "" {
+			req.Header.Set("Authorization", "Token "+p.Token)
+		}
+	}
+	for k, v := range p.Headers {
+		if strings.ToLower(k) == "host" {
+			req.Host = v
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer internal.IOClose(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorLine := ""
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
+		if scanner.Scan() {
+			errorLine = scanner.Text()
+		}
+		return &statusError{
+			code: resp.StatusCode,
+			err:  fmt.Errorf("when writing to [%s] received status code: %d. body: %s", p.URL, resp.StatusCode, errorLine),
+		}
+	}
+
+	level.Debug(p.logger).Log("msg", "write_influxdb", "url", p.URL, "bytes", len(body))
+	return nil
+}
+
+// splitLines splits the body at line ends into batches not larger than max bytes,
+// a single line larger than max is sent alone.
+func splitLines(body []byte, max int) [][]byte {
+	var batches [][]byte
+	for len(body) > max {
+		i := bytes.LastIndexByte(body[:max], '\n')
+		if i < 0 {
+			if i = bytes.IndexByte(body, '\n'); i < 0 {
+				break
+			}
+		}
+		batches = append(batches, body[:i+1])
+		body = body[i+1:]
+	}
+	if len(body) > 0 {
+		batches = append(batches, body)
+	}
+	return batches
+}
+
+func init() {
+	outputs.RegisterFactory("influxdb", func(opts ...plugins.Option) (plugins.Output, error) {
+		options := &plugins.Options{}
+		for _, opt := range opts {
+			opt(options)
+		}
+
+		p := &InfluxDB{
+			logger: options.Logger,
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		}
+
+		if p.TlsConfig != nil {
+			tlsConfig, err := p.TlsConfig.GetTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+
+		timeout := defaultTimeout
+		if p.Timeout != 0 {
+			timeout = time.Duration(p.Timeout)
+		}
+
+		p.client = &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		}
+
+		if p.SerializerConfig.Name == "" {
+			p.SerializerConfig.Name = defaultSerializer
+		}
+
+		var err error
+		p.SerializerConfig.Logger = options.Logger
+		p.serializer, err = serializers.NewSerializer(&p.SerializerConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
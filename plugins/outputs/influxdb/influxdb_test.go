@@ -0,0 +1,134 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package influxdb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// linesSerializer serializes the names of the metric families as the lines
+type linesSerializer struct{}
+
+func (linesSerializer) Serialize(metric *dto.MetricFamily) ([]byte, error) {
+	return []byte(metric.GetName() + "\n"), nil
+}
+
+func (s linesSerializer) SerializeBatch(metrics []*dto.MetricFamily) ([]byte, error) {
+	var lines []byte
+	for _, metric := range metrics {
+		line, _ := s.Serialize(metric)
+		lines = append(lines, line...)
+	}
+	return lines, nil
+}
+
+// influxServer records the bodies written, and answers the status codes of the requests in order
+type influxServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	codes  []int
+	bodies []string
+}
+
+func newInfluxServer(t *testing.T, codes ...int) *influxServer {
+	s := &influxServer{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		s.mu.Lock()
+		code := http.StatusNoContent
+		if len(s.codes) > 0 {
+			code, s.codes = s.codes[0], s.codes[1:]
+		}
+		if code == http.StatusNoContent {
+			s.bodies = append(s.bodies, string(body))
+		}
+		s.mu.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestInfluxDB(t *testing.T, u string) *InfluxDB {
+	p := &InfluxDB{
+		URL:          u,
+		Database:     "db",
+		MaxBodyBytes: 4, // a batch of each line "mN\n"
+		logger:       log.NewNopLogger(),
+		client:       http.DefaultClient,
+		serializer:   linesSerializer{},
+	}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func families(names ...string) []*dto.MetricFamily {
+	mfs := make([]*dto.MetricFamily, 0, len(names))
+	for _, n := range names {
+		name := n
+		mfs = append(mfs, &dto.MetricFamily{Name: &name})
+	}
+	return mfs
+}
+
+func TestWriteUnsentBatches(t *testing.T) {
+	s := newInfluxServer(t, http.StatusNoContent, http.StatusServiceUnavailable)
+	p := newTestInfluxDB(t, s.URL)
+
+	err := p.Write(families("m1", "m2", "m3"))
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 batches") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the batches failed are written before the next ones, the batch written is not written again
+	if err := p.Write(families("m4")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"m1\n", "m2\n", "m3\n", "m4\n"}
+	if strings.Join(s.bodies, "") != strings.Join(expected, "") {
+		t.Errorf("unexpected bodies %q, expected %q", s.bodies, expected)
+	}
+}
+
+func TestWriteRejectedBatch(t *testing.T) {
+	s := newInfluxServer(t, http.StatusBadRequest)
+	p := newTestInfluxDB(t, s.URL)
+
+	if err := p.Write(families("m1", "m2")); err == nil {
+		t.Fatal("expected the error of the batch rejected")
+	}
+	if err := p.Write(families("m3")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"m2\n", "m3\n"}
+	if strings.Join(s.bodies, "") != strings.Join(expected, "") {
+		t.Errorf("unexpected bodies %q, expected %q", s.bodies, expected)
+	}
+}
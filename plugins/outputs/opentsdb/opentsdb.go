@@ -0,0 +1,341 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package opentsdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/internal"
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/outputs"
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers/opentsdb"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/builder"
+	"trellis.tech/trellis/common.v1/crypto/tls"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	maxErrMsgLen      = 1024
+	maxReportedErrors = 10
+
+	defaultURL         = "http://127.0.0.1:4242"
+	defaultAddress     = "127.0.0.1:4242"
+	defaultTimeout     = 10 * time.Second
+	defaultBatchSize   = 50
+	defaultSerializer  = "opentsdb"
+	defaultContentType = "application/json"
+)
+
+const (
+	modeHTTP   = "http"
+	modeTelnet = "telnet"
+)
+
+type OpenTSDB struct {
+	// Mode is http for /api/put or telnet for "put" lines over tcp, defaults http
+	Mode string `yaml:"mode" json:"mode"`
+
+	// http
+	URL      string            `yaml:"url" json:"url"`
+	Username string            `yaml:"username" json:"username"`
+	Password string            `yaml:"password" json:"password"`
+	Headers  map[string]string `yaml:"headers" json:"headers"`
+	// BatchSize is the max number of points of one /api/put request
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+
+	// telnet
+	Address string `yaml:"address" json:"address"`
+
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+
+	SerializerConfig serializers.SerializerConfig `yaml:"serializer_config" json:"serializer_config"`
+
+	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
+
+	logger     log.Logger
+	timeout    time.Duration
+	client     *http.Client
+	serializer *opentsdb.Serializer
+	putURL     string
+	conn       net.Conn
+}
+
+// putDetails is the response of /api/put?details
+type putDetails struct {
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+	Errors  []struct {
+		Datapoint *opentsdb.Point `json:"datapoint"`
+		Error     string          `json:"error"`
+	} `json:"errors"`
+}
+
+func (p *OpenTSDB) SampleConfig() string {
+	return ""
+}
+
+func (p *OpenTSDB) Description() string {
+	return "A plugin that writes metrics to OpenTSDB with /api/put or telnet put"
+}
+
+func (p *OpenTSDB) Connect() error {
+	if p.Mode == "" {
+		p.Mode = modeHTTP
+	}
+	if p.BatchSize <= 0 {
+		p.BatchSize = defaultBatchSize
+	}
+
+	switch p.Mode {
+	case modeHTTP:
+		if p.URL == "" {
+			p.URL = defaultURL
+		}
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			return err
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/put"
+		u.RawQuery = "details"
+		p.putURL = u.String()
+		return nil
+	case modeTelnet:
+		if p.Address == "" {
+			p.Address = defaultAddress
+		}
+		return p.dial()
+	default:
+		return fmt.Errorf("unsupported opentsdb mode: %s", p.Mode)
+	}
+}
+
+func (p *OpenTSDB) Close() error {
+	if p.conn != nil {
+		err := p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *OpenTSDB) Write(metrics []*dto.MetricFamily) error {
+	points := p.serializer.Points(metrics)
+	if len(points) == 0 {
+		return nil
+	}
+
+	if p.Mode == modeTelnet {
+		return p.writeTelnet(points)
+	}
+
+	// the following batches are still sent when one of them fails
+	var errs []string
+	for len(points) > 0 {
+		n := p.BatchSize
+		if n > len(points) {
+			n = len(points)
+		}
+		if err := p.writeHTTP(points[:n]); err != nil {
+			errs = append(errs, err.Error())
+		}
+		points = points[n:]
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *OpenTSDB) writeHTTP(points []*opentsdb.Point) error {
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.putURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	if p.Username != "" || p.Password != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	req.Header.Set("User-Agent", builder.Version())
+	req.Header.Set("Content-Type", defaultContentType)
+	for k, v := range p.Headers {
+		if strings.ToLower(k) == "host" {
+			req.Host = v
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer internal.IOClose(resp.Body)
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("when writing to [%s] received error: %v", p.URL, err)
+	}
+
+	// OpenTSDB answers 400 with the details when some of the points are rejected
+	details := &putDetails{}
+	if jsonErr := json.Unmarshal(respBody, details); jsonErr == nil && (details.Success > 0 || details.Failed > 0) {
+		if details.Failed == 0 {
+			return nil
+		}
+		for i, e := range details.Errors {
+			if i >= maxReportedErrors {
+				break
+			}
+			metric := ""
+			if e.Datapoint != nil {
+				metric = e.Datapoint.Metric
+			}
+			level.Warn(p.logger).Log("msg", "opentsdb_put_point_failed", "metric", metric, "error", e.Error)
+		}
+		return fmt.Errorf("when writing to [%s] %d of %d points failed", p.URL, details.Failed, details.Success+details.Failed)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorLine := ""
+		scanner := bufio.NewScanner(io.LimitReader(bytes.NewReader(respBody), maxErrMsgLen))
+		if scanner.Scan() {
+			errorLine = scanner.Text()
+		}
+		return fmt.Errorf("when writing to [%s] received status code: %d. body: %s", p.URL, resp.StatusCode, errorLine)
+	}
+
+	return nil
+}
+
+func (p *OpenTSDB) dial() error {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	conn, err := dialer.Dial("tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	return nil
+}
+
+// writeTelnet writes the points over the connection, and reconnects once when the connection
+// was closed by the TSD. After a partial write only the lines not completely written are sent
+// again, the line cut off is sent again as a whole. The lines written into a connection which is
+// closed before the TSD reads them are lost, as telnet put has no acknowledgement.
+func (p *OpenTSDB) writeTelnet(points []*opentsdb.Point) error {
+	buf := &bytes.Buffer{}
+	for _, point := range points {
+		buf.WriteString(point.TelnetLine())
+	}
+	data := buf.Bytes()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if p.conn == nil {
+			if err = p.dial(); err != nil {
+				continue
+			}
+		}
+		if err = p.conn.SetWriteDeadline(time.Now().Add(p.timeout)); err == nil {
+			var n int
+			if n, err = p.conn.Write(data); err == nil {
+				return nil
+			}
+			// resume after the last line completely written
+			data = data[bytes.LastIndexByte(data[:n], '\n')+1:]
+		}
+		level.Warn(p.logger).Log("msg", "opentsdb_telnet_write_failed", "address", p.Address, "error", err)
+		_ = p.Close()
+	}
+	return fmt.Errorf("when writing to [%s] received error: %v", p.Address, err)
+}
+
+func init() {
+	outputs.RegisterFactory("opentsdb", func(opts ...plugins.Option) (plugins.Output, error) {
+		options := &plugins.Options{}
+		for _, opt := range opts {
+			opt(options)
+		}
+
+		p := &OpenTSDB{
+			logger: options.Logger,
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		}
+
+		if p.TlsConfig != nil {
+			tlsConfig, err := p.TlsConfig.GetTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+
+		p.timeout = defaultTimeout
+		if p.Timeout != 0 {
+			p.timeout = time.Duration(p.Timeout)
+		}
+
+		p.client = &http.Client{
+			Timeout:   p.timeout,
+			Transport: transport,
+		}
+
+		if p.SerializerConfig.Name == "" {
+			p.SerializerConfig.Name = defaultSerializer
+		}
+
+		p.SerializerConfig.Logger = options.Logger
+		serializer, err := serializers.NewSerializer(&p.SerializerConfig)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if p.serializer, ok = serializer.(*opentsdb.Serializer); !ok {
+			return nil, fmt.Errorf("opentsdb output requires the opentsdb serializer, got: %s", p.SerializerConfig.Name)
+		}
+
+		return p, nil
+	})
+}
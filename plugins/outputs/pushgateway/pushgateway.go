@@ -0,0 +1,360 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pushgateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/internal"
+	"trellis.tech/kolekti/prome_exporters/plugins"
+	"trellis.tech/kolekti/prome_exporters/plugins/outputs"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"trellis.tech/trellis/common.v1/builder"
+	"trellis.tech/trellis/common.v1/crypto/tls"
+	"trellis.tech/trellis/common.v1/types"
+)
+
+const (
+	maxErrMsgLen   = 1024
+	defaultURL     = "http://127.0.0.1:9091"
+	defaultJob     = "kolekti"
+	defaultTimeout = 10 * time.Second
+	defaultMethod  = http.MethodPost
+
+	labelJob     = "job"
+	base64Suffix = "@base64"
+)
+
+type Pushgateway struct {
+	URL string `yaml:"url" json:"url"`
+	Job string `yaml:"job" json:"job"`
+	// GroupingLabels are the labels whose values build the grouping key,
+	// the metrics are pushed to one group per distinct values
+	GroupingLabels []string `yaml:"grouping_labels" json:"grouping_labels"`
+	// Grouping are static labels appended to every grouping key
+	Grouping map[string]string `yaml:"grouping" json:"grouping"`
+	// Method is PUT to replace the whole group, or POST to replace only the
+	// pushed metric names, defaults POST
+	Method string `yaml:"method" json:"method"`
+	// DeleteOnClose deletes the pushed groups when the output is closed
+	DeleteOnClose bool `yaml:"delete_on_close" json:"delete_on_close"`
+
+	Username string            `yaml:"username" json:"username"`
+	Password string            `yaml:"password" json:"password"`
+	Headers  map[string]string `yaml:"headers" json:"headers"`
+
+	Timeout types.Duration `yaml:"timeout" json:"timeout"`
+
+	TlsConfig *tls.Config `yaml:"tls_config" json:"tls_config"`
+
+	logger log.Logger
+	client *http.Client
+
+	groupingNames []string
+	grouping      map[string]bool
+
+	mu     sync.Mutex
+	pushed map[string]bool
+}
+
+// group is the metrics pushed with one grouping key
+type group struct {
+	path     string
+	names    []string
+	families map[string]*dto.MetricFamily
+}
+
+func (p *Pushgateway) SampleConfig() string {
+	return ""
+}
+
+func (p *Pushgateway) Description() string {
+	return "A plugin that pushes metrics to the Prometheus Pushgateway"
+}
+
+func (p *Pushgateway) Connect() error {
+	if p.URL == "" {
+		p.URL = defaultURL
+	}
+	if p.Job == "" {
+		p.Job = defaultJob
+	}
+	if p.Method == "" {
+		p.Method = defaultMethod
+	}
+	p.Method = strings.ToUpper(p.Method)
+	if p.Method != http.MethodPost && p.Method != http.MethodPut {
+		return fmt.Errorf("invalid method [%s] %s", p.URL, p.Method)
+	}
+
+	p.groupingNames = append([]string(nil), p.GroupingLabels...)
+	staticNames := make([]string, 0, len(p.Grouping))
+	for name := range p.Grouping {
+		staticNames = append(staticNames, name)
+	}
+	sort.Strings(staticNames)
+	p.groupingNames = append(p.groupingNames, staticNames...)
+
+	p.grouping = make(map[string]bool, len(p.groupingNames))
+	for _, name := range p.groupingNames {
+		if name == labelJob {
+			return fmt.Errorf("job can not be a grouping label [%s]", p.URL)
+		}
+		p.grouping[name] = true
+	}
+	p.pushed = make(map[string]bool)
+	return nil
+}
+
+// Close deletes the pushed groups if DeleteOnClose
+func (p *Pushgateway) Close() error {
+	if !p.DeleteOnClose {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []string
+	for path := range p.pushed {
+		if err := p.do(http.MethodDelete, path, nil); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(p.pushed, path)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete groups: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *Pushgateway) Write(metrics []*dto.MetricFamily) error {
+	groups := p.groups(metrics)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []string
+	for _, g := range groups {
+		buf := &bytes.Buffer{}
+		enc := expfmt.NewEncoder(buf, expfmt.FmtProtoDelim)
+		for _, name := range g.names {
+			if err := enc.Encode(g.families[name]); err != nil {
+				return err
+			}
+		}
+
+		if err := p.do(p.Method, g.path, buf.Bytes()); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		p.pushed[g.path] = true
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to push groups: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// groups splits the metrics by grouping key. The grouping labels are removed
+// from the metrics as the pushgateway adds them, and so are the timestamps
+// which the pushgateway rejects.
+func (p *Pushgateway) groups(metrics []*dto.MetricFamily) []*group {
+	var (
+		groups = make(map[string]*group)
+		paths  []string
+	)
+
+	for _, mf := range metrics {
+		for _, m := range mf.GetMetric() {
+			values := make(map[string]string, len(p.groupingNames))
+			for name, value := range p.Grouping {
+				values[name] = value
+			}
+
+			metric := &dto.Metric{
+				Gauge:     m.Gauge,
+				Counter:   m.Counter,
+				Summary:   m.Summary,
+				Untyped:   m.Untyped,
+				Histogram: m.Histogram,
+			}
+			for _, lp := range m.GetLabel() {
+				if p.grouping[lp.GetName()] {
+					if _, ok := p.Grouping[lp.GetName()]; !ok {
+						values[lp.GetName()] = lp.GetValue()
+					}
+					continue
+				}
+				metric.Label = append(metric.Label, lp)
+			}
+
+			path := p.groupingPath(values)
+			g, ok := groups[path]
+			if !ok {
+				g = &group{path: path, families: make(map[string]*dto.MetricFamily)}
+				groups[path] = g
+				paths = append(paths, path)
+			}
+
+			family, ok := g.families[mf.GetName()]
+			if !ok {
+				family = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				g.families[mf.GetName()] = family
+				g.names = append(g.names, mf.GetName())
+			}
+			family.Metric = append(family.Metric, metric)
+		}
+	}
+
+	result := make([]*group, 0, len(paths))
+	for _, path := range paths {
+		result = append(result, groups[path])
+	}
+	return result
+}
+
+// groupingPath returns "/metrics/job/<job>/<label>/<value>..." with the values
+// containing "/" or being empty base64 encoded as "<label>@base64/<value>".
+func (p *Pushgateway) groupingPath(values map[string]string) string {
+	buf := &strings.Builder{}
+	buf.WriteString("/metrics")
+	writePair(buf, labelJob, p.Job)
+	for _, name := range p.groupingNames {
+		writePair(buf, name, values[name])
+	}
+	return buf.String()
+}
+
+func writePair(buf *strings.Builder, name, value string) {
+	buf.WriteByte('/')
+	buf.WriteString(name)
+	if value == "" || strings.Contains(value, "/") {
+		buf.WriteString(base64Suffix)
+		buf.WriteByte('/')
+		if value == "" {
+			// the pushgateway reads "=" as the empty value
+			buf.WriteByte('=')
+		} else {
+			buf.WriteString(base64.RawURLEncoding.EncodeToString([]byte(value)))
+		}
+		return
+	}
+	buf.WriteByte('/')
+	buf.WriteString(url.PathEscape(value))
+}
+
+func (p *Pushgateway) do(method, path string, body []byte) error {
+	target := strings.TrimSuffix(p.URL, "/") + path
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewBuffer(body)
+	}
+	req, err := http.NewRequest(method, target, reqBody)
+	if err != nil {
+		return err
+	}
+
+	if p.Username != "" || p.Password != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	req.Header.Set("User-Agent", builder.Version())
+	if body != nil {
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	}
+	for k, v := range p.Headers {
+		if strings.ToLower(k) == "host" {
+			req.Host = v
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer internal.IOClose(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorLine := ""
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
+		if scanner.Scan() {
+			errorLine = scanner.Text()
+		}
+		return fmt.Errorf("when %s [%s] received status code: %d. body: %s", method, target, resp.StatusCode, errorLine)
+	}
+
+	level.Debug(p.logger).Log("msg", "pushgateway_request", "method", method, "url", target)
+	return nil
+}
+
+func init() {
+	outputs.RegisterFactory("pushgateway", func(opts ...plugins.Option) (plugins.Output, error) {
+		options := &plugins.Options{}
+		for _, opt := range opts {
+			opt(options)
+		}
+
+		p := &Pushgateway{
+			logger: options.Logger,
+		}
+
+		if options.Config != nil {
+			if err := options.Config.ToObject("", p); err != nil {
+				return nil, err
+			}
+		}
+
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		}
+
+		if p.TlsConfig != nil {
+			tlsConfig, err := p.TlsConfig.GetTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+
+		timeout := defaultTimeout
+		if p.Timeout != 0 {
+			timeout = time.Duration(p.Timeout)
+		}
+
+		p.client = &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		}
+
+		return p, nil
+	})
+}
@@ -35,6 +35,8 @@ type Option func(*Options)
 type Options struct {
 	Config config.Config
 	Logger log.Logger
+	// Host is the host identity resolved by the agent
+	Host string
 }
 
 func Config(c config.Config) Option {
@@ -48,3 +50,9 @@ func Logger(l log.Logger) Option {
 		o.Logger = l
 	}
 }
+
+func Host(host string) Option {
+	return func(o *Options) {
+		o.Host = host
+	}
+}
@@ -15,6 +15,14 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package all
 
 import (
+	// graphite
+	_ "trellis.tech/kolekti/prome_exporters/plugins/serializers/graphite"
+	// influx
+	_ "trellis.tech/kolekti/prome_exporters/plugins/serializers/influx"
+	// json
+	_ "trellis.tech/kolekti/prome_exporters/plugins/serializers/json"
+	// opentsdb
+	_ "trellis.tech/kolekti/prome_exporters/plugins/serializers/opentsdb"
 	// prometheus
 	_ "trellis.tech/kolekti/prome_exporters/plugins/serializers/prometheus"
 )
@@ -14,23 +14,77 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 
 package serializers
 
-var defaultSerializerConfig = &SerializerConfig{
-	Name: "prometheus",
-}
+import (
+	"reflect"
+
+	"github.com/go-kit/log"
+	"gopkg.in/yaml.v2"
+	"trellis.tech/trellis/common.v1/config"
+	"trellis.tech/trellis/common.v1/errcode"
+)
+
+const defaultSerializerName = "prometheus"
 
 type SerializerConfig struct {
-	Name string `yaml:"name" json:"name"`
+	Name    string         `yaml:"name" json:"name"`
+	Options config.Options `yaml:"options" json:"options"`
+
+	Logger log.Logger `yaml:"-" json:"-"`
 }
 
 func NewSerializer(c *SerializerConfig) (Serializer, error) {
-	if c == nil || c.Name == "" {
-		c = defaultSerializerConfig
+	if c == nil {
+		c = &SerializerConfig{}
+	}
+
+	name := c.Name
+	if name == "" {
+		name = defaultSerializerName
 	}
 
-	f, err := GetFactory(c.Name)
+	f, err := GetFactory(name)
 	if err != nil {
 		return nil, err
 	}
 
-	return f()
+	logger := c.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	opts := []Option{
+		Logger(log.With(logger, "serializer", name)),
+	}
+	if c.Options != nil {
+		opts = append(opts, Config(c.Options.ToConfig()), rawOptions(c.Options))
+	}
+
+	return f(opts...)
+}
+
+// ToObject decodes the serializer options into v, a pointer to the serializer's
+// typed options, and rejects the keys which v does not declare.
+func (o *Options) ToObject(v interface{}) error {
+	if o.Config == nil {
+		return nil
+	}
+
+	if o.raw != nil {
+		bs, err := yaml.Marshal(o.raw)
+		if err != nil {
+			return err
+		}
+		strict := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err = yaml.UnmarshalStrict(bs, strict); err != nil {
+			return errcode.Newf("invalid serializer options: %v", err)
+		}
+	}
+
+	return o.Config.ToObject("", v)
+}
+
+func rawOptions(raw config.Options) Option {
+	return func(o *Options) {
+		o.raw = raw
+	}
 }
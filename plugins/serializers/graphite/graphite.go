@@ -0,0 +1,242 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package graphite
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func init() {
+	serializers.RegisterFactory("graphite", NewSerializer)
+}
+
+const (
+	defaultTemplate    = "name.tags"
+	defaultReplaceChar = "_"
+
+	// template tokens
+	tokenName = "name"
+	tokenTags = "tags"
+
+	labelQuantile = "quantile"
+	labelBucket   = "le"
+	suffixSum     = "_sum"
+	suffixCount   = "_count"
+	suffixBucket  = "_bucket"
+)
+
+var (
+	// characters allowed in a node of the plaintext path
+	invalidPathReg = regexp.MustCompile(`[^a-zA-Z0-9\-_:]`)
+	// characters allowed in graphite tag names and values
+	invalidTagReg = regexp.MustCompile(`[^a-zA-Z0-9\-_:.]`)
+)
+
+// Serializer writes the metric families with the graphite plaintext protocol:
+// "<path> <value> <timestamp>\n".
+//
+// Template is a dot separated list of tokens building the path: "name" is the
+// metric name, "tags" are the values of the labels not used by the other tokens
+// sorted by label name, any other token is the value of the label it names.
+// eg: "host.name.tags" with {host="a",cpu="0"} gives "a.node_cpu.0".
+type Serializer struct {
+	logger log.Logger
+
+	Prefix   string `yaml:"prefix" json:"prefix"`
+	Template string `yaml:"template" json:"template"`
+	// TagSupport writes the labels as graphite tags: "<prefix>.<name>;key=value",
+	// the template is not used
+	TagSupport bool `yaml:"tag_support" json:"tag_support"`
+	// ReplaceChar replaces the characters not allowed in the path or in the tags
+	ReplaceChar string `yaml:"replace_char" json:"replace_char"`
+
+	tokens []string
+}
+
+func NewSerializer(opts ...serializers.Option) (serializers.Serializer, error) {
+	options := &serializers.Options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	s := &Serializer{logger: options.Logger}
+	if err := options.ToObject(s); err != nil {
+		return nil, err
+	}
+
+	if s.logger == nil {
+		s.logger = log.NewNopLogger()
+	}
+	if s.Template == "" {
+		s.Template = defaultTemplate
+	}
+	if s.ReplaceChar == "" {
+		s.ReplaceChar = defaultReplaceChar
+	}
+	s.tokens = strings.Split(s.Template, ".")
+
+	return s, nil
+}
+
+func (s *Serializer) Serialize(metric *dto.MetricFamily) ([]byte, error) {
+	return s.SerializeBatch([]*dto.MetricFamily{metric})
+}
+
+func (s *Serializer) SerializeBatch(metrics []*dto.MetricFamily) ([]byte, error) {
+	var (
+		buf = &bytes.Buffer{}
+		now = time.Now().Unix()
+	)
+
+	for _, mf := range metrics {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs() / int64(time.Second/time.Millisecond)
+			}
+
+			write := func(metric string, value float64, extraName, extraValue string) {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					level.Debug(s.logger).Log("msg", "drop_unsupported_value", "metric", metric, "value", value)
+					return
+				}
+				labels := labelsMap(m.GetLabel())
+				if extraName != "" {
+					labels[extraName] = extraValue
+				}
+				buf.WriteString(s.path(metric, labels))
+				buf.WriteByte(' ')
+				buf.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+				buf.WriteByte(' ')
+				buf.WriteString(strconv.FormatInt(ts, 10))
+				buf.WriteByte('\n')
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				write(name, m.GetCounter().GetValue(), "", "")
+			case dto.MetricType_GAUGE:
+				write(name, m.GetGauge().GetValue(), "", "")
+			case dto.MetricType_UNTYPED:
+				write(name, m.GetUntyped().GetValue(), "", "")
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				write(name+suffixSum, summary.GetSampleSum(), "", "")
+				write(name+suffixCount, float64(summary.GetSampleCount()), "", "")
+				for _, q := range summary.GetQuantile() {
+					write(name, q.GetValue(), labelQuantile, strconv.FormatFloat(q.GetQuantile(), 'f', -1, 64))
+				}
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				write(name+suffixSum, histogram.GetSampleSum(), "", "")
+				write(name+suffixCount, float64(histogram.GetSampleCount()), "", "")
+				for _, b := range histogram.GetBucket() {
+					bound := "Inf"
+					if !math.IsInf(b.GetUpperBound(), 1) {
+						bound = strconv.FormatFloat(b.GetUpperBound(), 'f', -1, 64)
+					}
+					write(name+suffixBucket, float64(b.GetCumulativeCount()), labelBucket, bound)
+				}
+			default:
+				level.Debug(s.logger).Log("msg", "unsupported_metric_type", "metric", mf.GetName(), "type", mf.GetType())
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *Serializer) path(name string, labels map[string]string) string {
+	var nodes []string
+	if s.Prefix != "" {
+		nodes = append(nodes, s.Prefix)
+	}
+
+	if s.TagSupport {
+		nodes = append(nodes, s.sanitizePath(name))
+		path := strings.Join(nodes, ".")
+		for _, k := range sortedKeys(labels) {
+			if labels[k] == "" {
+				continue
+			}
+			path += ";" + s.sanitizeTag(k) + "=" + s.sanitizeTag(labels[k])
+		}
+		return path
+	}
+
+	used := make(map[string]bool)
+	for _, token := range s.tokens {
+		if token != tokenName && token != tokenTags {
+			used[token] = true
+		}
+	}
+
+	for _, token := range s.tokens {
+		switch token {
+		case tokenName:
+			nodes = append(nodes, s.sanitizePath(name))
+		case tokenTags:
+			for _, k := range sortedKeys(labels) {
+				if !used[k] && labels[k] != "" {
+					nodes = append(nodes, s.sanitizePath(labels[k]))
+				}
+			}
+		default:
+			if v := labels[token]; v != "" {
+				nodes = append(nodes, s.sanitizePath(v))
+			}
+		}
+	}
+
+	return strings.Join(nodes, ".")
+}
+
+func (s *Serializer) sanitizePath(v string) string {
+	return invalidPathReg.ReplaceAllString(v, s.ReplaceChar)
+}
+
+func (s *Serializer) sanitizeTag(v string) string {
+	return invalidTagReg.ReplaceAllString(v, s.ReplaceChar)
+}
+
+func labelsMap(labels []*dto.LabelPair) map[string]string {
+	m := make(map[string]string, len(labels)+1)
+	for _, lp := range labels {
+		m[lp.GetName()] = lp.GetValue()
+	}
+	return m
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
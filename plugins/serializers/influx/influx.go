@@ -0,0 +1,236 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/errcode"
+)
+
+func init() {
+	serializers.RegisterFactory("influx", NewSerializer)
+}
+
+const (
+	defaultFieldKey   = "value"
+	defaultPrecision  = "ns"
+	labelQuantile     = "quantile"
+	labelBucket       = "le"
+	fieldSuffixSum    = "_sum"
+	fieldSuffixCount  = "_count"
+	fieldSuffixBucket = "_bucket"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+	precisions = map[string]int64{
+		"ns": int64(time.Millisecond / time.Nanosecond),
+		"us": int64(time.Millisecond / time.Microsecond),
+		"ms": 1,
+		"s":  0,
+	}
+)
+
+// Serializer writes the metric families with the InfluxDB line protocol.
+type Serializer struct {
+	logger log.Logger
+
+	// NameSplit separates the family name into the measurement and the field key,
+	// eg: "_" turns "node_cpu_seconds_total" into measurement "node" and field "cpu_seconds_total"
+	NameSplit string `yaml:"name_split" json:"name_split"`
+	// NameSplitParts is the number of leading name parts used as the measurement, defaults 1
+	NameSplitParts int `yaml:"name_split_parts" json:"name_split_parts"`
+	// FieldKey is the field key of the families whose name is not split, defaults "value"
+	FieldKey string `yaml:"field_key" json:"field_key"`
+	// Precision of the timestamps: ns, us, ms or s, defaults ns
+	Precision string `yaml:"precision" json:"precision"`
+}
+
+func NewSerializer(opts ...serializers.Option) (serializers.Serializer, error) {
+	options := &serializers.Options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	s := &Serializer{logger: options.Logger}
+	if err := options.ToObject(s); err != nil {
+		return nil, err
+	}
+
+	if s.logger == nil {
+		s.logger = log.NewNopLogger()
+	}
+	if s.NameSplitParts <= 0 {
+		s.NameSplitParts = 1
+	}
+	if s.FieldKey == "" {
+		s.FieldKey = defaultFieldKey
+	}
+	if s.Precision == "" {
+		s.Precision = defaultPrecision
+	}
+	if _, ok := precisions[s.Precision]; !ok {
+		return nil, errcode.Newf("unsupported influx precision: %s", s.Precision)
+	}
+
+	return s, nil
+}
+
+// TimestampPrecision returns the precision of the serialized timestamps,
+// outputs use it to tell the server how to read them.
+func (s *Serializer) TimestampPrecision() string {
+	return s.Precision
+}
+
+func (s *Serializer) Serialize(metric *dto.MetricFamily) ([]byte, error) {
+	return s.SerializeBatch([]*dto.MetricFamily{metric})
+}
+
+func (s *Serializer) SerializeBatch(metrics []*dto.MetricFamily) ([]byte, error) {
+	var (
+		buf = &bytes.Buffer{}
+		now = time.Now().UnixNano() / int64(time.Millisecond)
+	)
+
+	for _, mf := range metrics {
+		measurement, field := s.splitName(mf.GetName())
+		for _, m := range mf.GetMetric() {
+			tags := tagsString(m.GetLabel())
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			timestamp := s.timestamp(ts)
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				s.writeLine(buf, measurement, tags, timestamp, field, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				s.writeLine(buf, measurement, tags, timestamp, field, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				s.writeLine(buf, measurement, tags, timestamp, field, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				s.writeLine(buf, measurement, tags, timestamp,
+					field+fieldSuffixSum, summary.GetSampleSum(),
+					field+fieldSuffixCount, float64(summary.GetSampleCount()))
+				for _, q := range summary.GetQuantile() {
+					s.writeLine(buf, measurement,
+						withTag(m.GetLabel(), labelQuantile, formatFloat(q.GetQuantile())),
+						timestamp, field, q.GetValue())
+				}
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				s.writeLine(buf, measurement, tags, timestamp,
+					field+fieldSuffixSum, histogram.GetSampleSum(),
+					field+fieldSuffixCount, float64(histogram.GetSampleCount()))
+				for _, b := range histogram.GetBucket() {
+					s.writeLine(buf, measurement,
+						withTag(m.GetLabel(), labelBucket, formatFloat(b.GetUpperBound())),
+						timestamp, field+fieldSuffixBucket, float64(b.GetCumulativeCount()))
+				}
+			default:
+				level.Debug(s.logger).Log("msg", "unsupported_metric_type", "metric", mf.GetName(), "type", mf.GetType())
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *Serializer) splitName(name string) (measurement, field string) {
+	if s.NameSplit == "" {
+		return name, s.FieldKey
+	}
+
+	parts := strings.Split(name, s.NameSplit)
+	if len(parts) <= s.NameSplitParts {
+		return name, s.FieldKey
+	}
+
+	return strings.Join(parts[:s.NameSplitParts], s.NameSplit), strings.Join(parts[s.NameSplitParts:], s.NameSplit)
+}
+
+func (s *Serializer) timestamp(ms int64) int64 {
+	if multiplier := precisions[s.Precision]; multiplier > 0 {
+		return ms * multiplier
+	}
+	return ms / int64(time.Second/time.Millisecond)
+}
+
+// writeLine writes one line with the fields given as key, value pairs,
+// the fields whose values are not supported by influx are dropped.
+func (s *Serializer) writeLine(buf *bytes.Buffer, measurement, tags string, timestamp int64, fields ...interface{}) {
+	var fieldsBuf []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, value := fields[i].(string), fields[i+1].(float64)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			level.Debug(s.logger).Log("msg", "drop_unsupported_value", "measurement", measurement, "field", key, "value", value)
+			continue
+		}
+		fieldsBuf = append(fieldsBuf, keyEscaper.Replace(key)+"="+formatFloat(value))
+	}
+	if len(fieldsBuf) == 0 {
+		return
+	}
+
+	buf.WriteString(measurementEscaper.Replace(measurement))
+	buf.WriteString(tags)
+	buf.WriteByte(' ')
+	buf.WriteString(strings.Join(fieldsBuf, ","))
+	fmt.Fprintf(buf, " %d\n", timestamp)
+}
+
+// tagsString returns the labels sorted by name as the tag set of a line,
+// including the leading comma.
+func tagsString(labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, lp := range labels {
+		if lp.GetName() == "" || lp.GetValue() == "" {
+			continue
+		}
+		pairs = append(pairs, keyEscaper.Replace(lp.GetName())+"="+keyEscaper.Replace(lp.GetValue()))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	sort.Strings(pairs)
+	return "," + strings.Join(pairs, ",")
+}
+
+func withTag(labels []*dto.LabelPair, name, value string) string {
+	ls := make([]*dto.LabelPair, 0, len(labels)+1)
+	ls = append(ls, labels...)
+	ls = append(ls, &dto.LabelPair{Name: &name, Value: &value})
+	return tagsString(ls)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
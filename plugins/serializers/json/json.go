@@ -0,0 +1,226 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/errcode"
+)
+
+func init() {
+	serializers.RegisterFactory("json", NewSerializer)
+}
+
+const (
+	formatArray  = "array"
+	formatNDJSON = "ndjson"
+)
+
+// FieldNames are the keys of a sample object
+type FieldNames struct {
+	Name      string `yaml:"name" json:"name"`
+	Type      string `yaml:"type" json:"type"`
+	Labels    string `yaml:"labels" json:"labels"`
+	Value     string `yaml:"value" json:"value"`
+	Timestamp string `yaml:"timestamp" json:"timestamp"`
+	Sum       string `yaml:"sum" json:"sum"`
+	Count     string `yaml:"count" json:"count"`
+	Buckets   string `yaml:"buckets" json:"buckets"`
+	Quantiles string `yaml:"quantiles" json:"quantiles"`
+}
+
+var defaultFieldNames = FieldNames{
+	Name:      "name",
+	Type:      "type",
+	Labels:    "labels",
+	Value:     "value",
+	Timestamp: "timestamp",
+	Sum:       "sum",
+	Count:     "count",
+	Buckets:   "buckets",
+	Quantiles: "quantiles",
+}
+
+type bucket struct {
+	UpperBound string `json:"le"`
+	Count      uint64 `json:"count"`
+}
+
+type quantile struct {
+	Quantile float64  `json:"quantile"`
+	Value    *float64 `json:"value"`
+}
+
+// Serializer writes every sample as a JSON object:
+//
+//	{"name":"up","type":"gauge","labels":{"job":"node"},"value":1,"timestamp":1650000000000}
+//
+// summaries and histograms have sum, count and quantiles or buckets instead of value,
+// timestamps are in milliseconds and the values which are NaN or infinite are null.
+type Serializer struct {
+	// Format is array for one JSON array per batch, or ndjson for one object per line
+	Format     string     `yaml:"format" json:"format"`
+	FieldNames FieldNames `yaml:"field_names" json:"field_names"`
+}
+
+func NewSerializer(opts ...serializers.Option) (serializers.Serializer, error) {
+	options := &serializers.Options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	s := &Serializer{}
+	if err := options.ToObject(s); err != nil {
+		return nil, err
+	}
+
+	switch s.Format {
+	case "":
+		s.Format = formatArray
+	case formatArray, formatNDJSON:
+	default:
+		return nil, errcode.Newf("unsupported json format: %s", s.Format)
+	}
+
+	fieldNames := []*string{
+		&s.FieldNames.Name, &s.FieldNames.Type, &s.FieldNames.Labels, &s.FieldNames.Value, &s.FieldNames.Timestamp,
+		&s.FieldNames.Sum, &s.FieldNames.Count, &s.FieldNames.Buckets, &s.FieldNames.Quantiles,
+	}
+	defaults := []string{
+		defaultFieldNames.Name, defaultFieldNames.Type, defaultFieldNames.Labels, defaultFieldNames.Value, defaultFieldNames.Timestamp,
+		defaultFieldNames.Sum, defaultFieldNames.Count, defaultFieldNames.Buckets, defaultFieldNames.Quantiles,
+	}
+	for i, name := range fieldNames {
+		if *name == "" {
+			*name = defaults[i]
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Serializer) Serialize(metric *dto.MetricFamily) ([]byte, error) {
+	return s.SerializeBatch([]*dto.MetricFamily{metric})
+}
+
+func (s *Serializer) SerializeBatch(metrics []*dto.MetricFamily) ([]byte, error) {
+	samples := s.samples(metrics)
+
+	if s.Format == formatArray {
+		if samples == nil {
+			samples = []map[string]interface{}{}
+		}
+		bs, err := json.Marshal(samples)
+		if err != nil {
+			return nil, err
+		}
+		return append(bs, '\n'), nil
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, sample := range samples {
+		if err := enc.Encode(sample); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Serializer) samples(metrics []*dto.MetricFamily) []map[string]interface{} {
+	var (
+		samples []map[string]interface{}
+		now     = time.Now().UnixNano() / int64(time.Millisecond)
+	)
+
+	for _, mf := range metrics {
+		typ := strings.ToLower(mf.GetType().String())
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+
+			sample := map[string]interface{}{
+				s.FieldNames.Name:      mf.GetName(),
+				s.FieldNames.Type:      typ,
+				s.FieldNames.Labels:    labels,
+				s.FieldNames.Timestamp: ts,
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				sample[s.FieldNames.Value] = finite(m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				sample[s.FieldNames.Value] = finite(m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				sample[s.FieldNames.Value] = finite(m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				quantiles := make([]quantile, 0, len(summary.GetQuantile()))
+				for _, q := range summary.GetQuantile() {
+					quantiles = append(quantiles, quantile{Quantile: q.GetQuantile(), Value: finite(q.GetValue())})
+				}
+				sample[s.FieldNames.Sum] = finite(summary.GetSampleSum())
+				sample[s.FieldNames.Count] = summary.GetSampleCount()
+				sample[s.FieldNames.Quantiles] = quantiles
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				buckets := make([]bucket, 0, len(histogram.GetBucket()))
+				for _, b := range histogram.GetBucket() {
+					buckets = append(buckets, bucket{UpperBound: formatBound(b.GetUpperBound()), Count: b.GetCumulativeCount()})
+				}
+				sample[s.FieldNames.Sum] = finite(histogram.GetSampleSum())
+				sample[s.FieldNames.Count] = histogram.GetSampleCount()
+				sample[s.FieldNames.Buckets] = buckets
+			default:
+				continue
+			}
+
+			samples = append(samples, sample)
+		}
+	}
+
+	return samples
+}
+
+// finite returns nil for the values which JSON can not encode
+func finite(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,274 @@
+/*
+Copyright © 2022 Henry Huang <hhh@rutcode.com>
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"trellis.tech/trellis/common.v1/errcode"
+)
+
+func init() {
+	serializers.RegisterFactory("opentsdb", NewSerializer)
+}
+
+const (
+	defaultMaxTags     = 8
+	defaultReplaceChar = "_"
+	defaultPrecision   = "ms"
+
+	labelQuantile = "quantile"
+	labelBucket   = "le"
+	suffixSum     = "_sum"
+	suffixCount   = "_count"
+	suffixBucket  = "_bucket"
+)
+
+// OpenTSDB accepts letters, numbers, '-', '_', '.' and '/' in metric names and tags
+var invalidCharsReg = regexp.MustCompile(`[^\p{L}\p{N}\-_./]`)
+
+// Point is a data point of the OpenTSDB /api/put body
+type Point struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// TelnetLine returns the point as a telnet "put" command
+func (p *Point) TelnetLine() string {
+	keys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.NewBufferString("put ")
+	buf.WriteString(p.Metric)
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(p.Timestamp, 10))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(p.Value, 'f', -1, 64))
+	for _, k := range keys {
+		buf.WriteByte(' ')
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(p.Tags[k])
+	}
+	buf.WriteByte('\n')
+	return buf.String()
+}
+
+// Serializer writes the metric families as the JSON array of OpenTSDB /api/put.
+type Serializer struct {
+	logger log.Logger
+
+	// MaxTags is the max number of tags of a point, the tags sorted by name
+	// after it are dropped. defaults 8 as tsd.storage.max_tags
+	MaxTags int `yaml:"max_tags" json:"max_tags"`
+	// ReplaceChar replaces the characters not allowed in metric names and tags
+	ReplaceChar string `yaml:"replace_char" json:"replace_char"`
+	// Precision of the timestamps: s or ms, defaults ms
+	Precision string `yaml:"precision" json:"precision"`
+	// DefaultTags are the tags of the points without any label, as OpenTSDB rejects the points
+	// without tags. defaults host=<hostname>, the points are dropped when it is empty
+	DefaultTags map[string]string `yaml:"default_tags" json:"default_tags"`
+}
+
+func NewSerializer(opts ...serializers.Option) (serializers.Serializer, error) {
+	options := &serializers.Options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	s := &Serializer{logger: options.Logger}
+	if err := options.ToObject(s); err != nil {
+		return nil, err
+	}
+
+	if s.logger == nil {
+		s.logger = log.NewNopLogger()
+	}
+	if s.MaxTags <= 0 {
+		s.MaxTags = defaultMaxTags
+	}
+	if s.ReplaceChar == "" {
+		s.ReplaceChar = defaultReplaceChar
+	}
+	if s.DefaultTags == nil {
+		if hostname, err := os.Hostname(); err == nil && hostname != "" {
+			s.DefaultTags = map[string]string{"host": hostname}
+		}
+	}
+	defaultTags := make(map[string]string, len(s.DefaultTags))
+	for k, v := range s.DefaultTags {
+		if v != "" {
+			defaultTags[s.sanitize(k)] = s.sanitize(v)
+		}
+	}
+	s.DefaultTags = defaultTags
+
+	switch s.Precision {
+	case "":
+		s.Precision = defaultPrecision
+	case "s", "ms":
+	default:
+		return nil, errcode.Newf("unsupported opentsdb precision: %s", s.Precision)
+	}
+
+	return s, nil
+}
+
+func (s *Serializer) Serialize(metric *dto.MetricFamily) ([]byte, error) {
+	return s.SerializeBatch([]*dto.MetricFamily{metric})
+}
+
+func (s *Serializer) SerializeBatch(metrics []*dto.MetricFamily) ([]byte, error) {
+	return json.Marshal(s.Points(metrics))
+}
+
+// Points converts the metric families to OpenTSDB data points, the values which are NaN or
+// infinite are dropped, and so are the points without tags when there are no DefaultTags.
+func (s *Serializer) Points(metrics []*dto.MetricFamily) []*Point {
+	var (
+		points []*Point
+		now    = time.Now().UnixNano() / int64(time.Millisecond)
+	)
+
+	for _, mf := range metrics {
+		name := s.sanitize(mf.GetName())
+		for _, m := range mf.GetMetric() {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			if s.Precision == "s" {
+				ts /= int64(time.Second / time.Millisecond)
+			}
+
+			add := func(metric string, value float64, extraName, extraValue string) {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					level.Debug(s.logger).Log("msg", "drop_unsupported_value", "metric", metric, "value", value)
+					return
+				}
+				tags := s.tags(metric, m.GetLabel(), extraName, extraValue)
+				if len(tags) == 0 {
+					if len(s.DefaultTags) == 0 {
+						level.Warn(s.logger).Log("msg", "drop_point_without_tags", "metric", metric)
+						return
+					}
+					for k, v := range s.DefaultTags {
+						tags[k] = v
+					}
+				}
+				points = append(points, &Point{
+					Metric:    metric,
+					Timestamp: ts,
+					Value:     value,
+					Tags:      tags,
+				})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue(), "", "")
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue(), "", "")
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue(), "", "")
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				add(name+suffixSum, summary.GetSampleSum(), "", "")
+				add(name+suffixCount, float64(summary.GetSampleCount()), "", "")
+				for _, q := range summary.GetQuantile() {
+					add(name, q.GetValue(), labelQuantile, strconv.FormatFloat(q.GetQuantile(), 'f', -1, 64))
+				}
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				add(name+suffixSum, histogram.GetSampleSum(), "", "")
+				add(name+suffixCount, float64(histogram.GetSampleCount()), "", "")
+				for _, b := range histogram.GetBucket() {
+					add(name+suffixBucket, float64(b.GetCumulativeCount()), labelBucket, formatBound(b.GetUpperBound()))
+				}
+			default:
+				level.Debug(s.logger).Log("msg", "unsupported_metric_type", "metric", mf.GetName(), "type", mf.GetType())
+			}
+		}
+	}
+
+	return points
+}
+
+// tags sanitizes the labels and keeps at most MaxTags of them sorted by name,
+// so that the same series always keeps the same tags. The extra tag, quantile or le,
+// distinguishes the series of a summary or histogram, so it is always kept.
+func (s *Serializer) tags(metric string, labels []*dto.LabelPair, extraName, extraValue string) map[string]string {
+	all := make(map[string]string, len(labels)+1)
+	for _, lp := range labels {
+		if lp.GetValue() == "" {
+			continue
+		}
+		all[s.sanitize(lp.GetName())] = s.sanitize(lp.GetValue())
+	}
+
+	limit := s.MaxTags
+	if extraName != "" {
+		delete(all, extraName)
+		limit--
+	}
+
+	tags := all
+	if len(all) > limit {
+		keys := make([]string, 0, len(all))
+		for k := range all {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		tags = make(map[string]string, s.MaxTags)
+		for _, k := range keys[:limit] {
+			tags[k] = all[k]
+		}
+		level.Debug(s.logger).Log("msg", "truncate_tags", "metric", metric, "dropped", len(keys)-limit)
+	}
+
+	if extraName != "" {
+		tags[extraName] = s.sanitize(extraValue)
+	}
+	return tags
+}
+
+func (s *Serializer) sanitize(v string) string {
+	return invalidCharsReg.ReplaceAllString(v, s.ReplaceChar)
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
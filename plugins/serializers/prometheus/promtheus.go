@@ -16,9 +16,12 @@ package prometheus
 
 import (
 	"bytes"
+	"sort"
+	"strings"
 
 	"trellis.tech/kolekti/prome_exporters/plugins/serializers"
 
+	"github.com/go-kit/log"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
@@ -27,10 +30,29 @@ func init() {
 	serializers.RegisterFactory("prometheus", NewSerializer)
 }
 
-type Serializer struct{}
+type Serializer struct {
+	logger log.Logger
 
-func NewSerializer(...serializers.Option) (serializers.Serializer, error) {
-	return &Serializer{}, nil
+	// DisableTimestamp drops the sample timestamps from the output
+	DisableTimestamp bool `yaml:"disable_timestamp" json:"disable_timestamp"`
+	// SortMetrics orders the families by name and their metrics by labels
+	SortMetrics bool `yaml:"sort_metrics" json:"sort_metrics"`
+	// NamePrefix is prepended to every metric family name
+	NamePrefix string `yaml:"name_prefix" json:"name_prefix"`
+}
+
+func NewSerializer(opts ...serializers.Option) (serializers.Serializer, error) {
+	options := &serializers.Options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	s := &Serializer{logger: options.Logger}
+	if err := options.ToObject(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 func (s *Serializer) Serialize(metric *dto.MetricFamily) ([]byte, error) {
@@ -39,10 +61,17 @@ func (s *Serializer) Serialize(metric *dto.MetricFamily) ([]byte, error) {
 
 func (s *Serializer) SerializeBatch(metrics []*dto.MetricFamily) ([]byte, error) {
 
+	if s.SortMetrics {
+		metrics = append([]*dto.MetricFamily(nil), metrics...)
+		sort.SliceStable(metrics, func(i, j int) bool {
+			return metrics[i].GetName() < metrics[j].GetName()
+		})
+	}
+
 	var buf bytes.Buffer
 	for _, mf := range metrics {
 		enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
-		err := enc.Encode(mf)
+		err := enc.Encode(s.convert(mf))
 		if err != nil {
 			return nil, err
 		}
@@ -50,3 +79,50 @@ func (s *Serializer) SerializeBatch(metrics []*dto.MetricFamily) ([]byte, error)
 
 	return buf.Bytes(), nil
 }
+
+// convert returns the family to encode, copying it when the options require
+// changes so that the caller's metrics are never modified.
+func (s *Serializer) convert(mf *dto.MetricFamily) *dto.MetricFamily {
+	if !s.DisableTimestamp && !s.SortMetrics && s.NamePrefix == "" {
+		return mf
+	}
+
+	name := s.NamePrefix + mf.GetName()
+	out := &dto.MetricFamily{
+		Name:   &name,
+		Help:   mf.Help,
+		Type:   mf.Type,
+		Metric: make([]*dto.Metric, 0, len(mf.GetMetric())),
+	}
+
+	for _, m := range mf.GetMetric() {
+		if s.DisableTimestamp && m.TimestampMs != nil {
+			m = &dto.Metric{
+				Label:     m.Label,
+				Gauge:     m.Gauge,
+				Counter:   m.Counter,
+				Summary:   m.Summary,
+				Untyped:   m.Untyped,
+				Histogram: m.Histogram,
+			}
+		}
+		out.Metric = append(out.Metric, m)
+	}
+
+	if s.SortMetrics {
+		sort.SliceStable(out.Metric, func(i, j int) bool {
+			return labelsString(out.Metric[i]) < labelsString(out.Metric[j])
+		})
+	}
+
+	return out
+}
+
+func labelsString(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		pairs = append(pairs, lp.GetName()+"="+lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -28,6 +28,8 @@ type Option func(*Options)
 type Options struct {
 	Config config.Config
 	Logger log.Logger
+
+	raw config.Options
 }
 
 func Config(c config.Config) Option {